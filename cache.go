@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"io/fs"
+	"os"
+	"sync"
+)
+
+// cacheVersion is bumped whenever the cached Metadata changes shape. Caches
+// from other versions are discarded and rebuilt.
+const cacheVersion = 3
+
+// MetadataCache holds the parsed .metadata files of a previous run, so only
+// files that changed since need to be parsed again.
+type MetadataCache struct {
+	Version int                   `json:"version"`
+	Source  string                `json:"source"`
+	Entries map[string]CacheEntry `json:"entries"`
+
+	mu   sync.Mutex
+	seen map[string]CacheEntry
+}
+
+// CacheEntry is the parsed metadata of one item with the modification time and
+// size of its file when it was read.
+type CacheEntry struct {
+	ModTime  int64    `json:"modTime"`
+	Size     int64    `json:"size"`
+	Metadata Metadata `json:"metadata"`
+}
+
+// loadCache reads the cache at path. A missing, unreadable or outdated cache,
+// or one made for another source directory, gives an empty one.
+func loadCache(path, source string) *MetadataCache {
+	cache := &MetadataCache{seen: make(map[string]CacheEntry)}
+	defer func() { cache.Source = source }()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			warnf("Warning: ignoring cache '%s': %v\n", path, err)
+		}
+		return cache
+	}
+
+	if err := json.Unmarshal(data, cache); err != nil {
+		warnf("Warning: ignoring cache '%s': %v\n", path, err)
+		cache.Entries = nil
+	}
+	if cache.Version != cacheVersion || cache.Source != source {
+		cache.Entries = nil
+	}
+	return cache
+}
+
+// lookup returns the cached metadata for file if its modification time and
+// size are unchanged.
+func (c *MetadataCache) lookup(file string, fi fs.FileInfo) (Metadata, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.Entries[file]
+	if !ok || entry.ModTime != fi.ModTime().UnixNano() || entry.Size != fi.Size() {
+		return Metadata{}, false
+	}
+	c.seen[file] = entry
+	return entry.Metadata, true
+}
+
+// store records the metadata parsed from file.
+func (c *MetadataCache) store(file string, fi fs.FileInfo, metadata Metadata) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.seen[file] = CacheEntry{ModTime: fi.ModTime().UnixNano(), Size: fi.Size(), Metadata: metadata}
+}
+
+// save writes the entries looked up or stored in this run to path, dropping
+// those of files that no longer exist.
+func (c *MetadataCache) save(path string) error {
+	c.Version = cacheVersion
+	c.Entries = c.seen
+	return writeJSONFile(path, c)
+}
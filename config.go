@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	pflag "github.com/spf13/pflag"
+)
+
+const systemConfigFile = "/etc/rmtree.conf"
+
+// userConfigFile returns the per-user config file location.
+func userConfigFile() string {
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, "rmtree", "config")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".config", "rmtree", "config")
+}
+
+// envName returns the environment variable that sets a flag, e.g. RMTREE_NO_COLOR for --no-color.
+func envName(flagName string) string {
+	return "RMTREE_" + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// commandLineOnly are the options that config files and the environment may
+// not set: --yes must be a deliberate confirmation of changes to the tablet,
+// and the others are one-off actions.
+var commandLineOnly = map[string]bool{"yes": true, "version": true, "print-config": true}
+
+// applyConfigLayers fills in flags that weren't given on the command line from,
+// in increasing precedence, the system config file, the user config file and
+// RMTREE_* environment variables.
+func applyConfigLayers(flags *pflag.FlagSet) error {
+	commandLine := make(map[string]bool)
+	flags.Visit(func(f *pflag.Flag) {
+		commandLine[f.Name] = true
+	})
+
+	set := func(name, value, source string) error {
+		if commandLineOnly[name] {
+			return fmt.Errorf("'%s' in %s can only be given on the command line", name, source)
+		}
+		if commandLine[name] {
+			return nil
+		}
+		f := flags.Lookup(name)
+		if f == nil {
+			return fmt.Errorf("unknown option '%s' in %s", name, source)
+		}
+		// Later layers replace list values instead of appending to them
+		if slice, ok := f.Value.(pflag.SliceValue); ok {
+			if err := slice.Replace(strings.Split(value, ",")); err != nil {
+				return fmt.Errorf("invalid value for '%s' in %s: %w", name, source, err)
+			}
+			f.Changed = true
+			return nil
+		}
+		if err := flags.Set(name, value); err != nil {
+			return fmt.Errorf("invalid value for '%s' in %s: %w", name, source, err)
+		}
+		return nil
+	}
+
+	for _, path := range []string{systemConfigFile, userConfigFile()} {
+		if path == "" {
+			continue
+		}
+		values, err := readConfigFile(path)
+		if err != nil {
+			return err
+		}
+		for _, kv := range values {
+			if err := set(kv[0], kv[1], path); err != nil {
+				return err
+			}
+		}
+	}
+
+	var err error
+	flags.VisitAll(func(f *pflag.Flag) {
+		if value, ok := os.LookupEnv(envName(f.Name)); ok && err == nil {
+			err = set(f.Name, value, envName(f.Name))
+		}
+	})
+	return err
+}
+
+// readConfigFile reads "option = value" lines, where option is a long flag
+// name. Blank lines and # comments are ignored. A missing file is not an error.
+func readConfigFile(path string) ([][2]string, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var values [][2]string
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(text, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected option = value", path, line)
+		}
+		values = append(values, [2]string{strings.TrimSpace(name), strings.TrimSpace(value)})
+	}
+	return values, scanner.Err()
+}
+
+// printConfig prints the effective configuration as JSON.
+func printConfig(config Config) error {
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: rmtree [path] [options]\n\n")
+	pflag.PrintDefaults()
+	fmt.Fprintf(os.Stderr, `
+Options are taken from, in increasing precedence:
+  1. built-in defaults
+  2. %s
+  3. %s
+  4. environment variables named after the option, e.g. %s=true
+  5. the command line
+Config files contain "option = value" lines, e.g. "icons = true".
+--yes, --version and --print-config are only accepted on the command line.
+`, systemConfigFile, "~/.config/rmtree/config ($XDG_CONFIG_HOME/rmtree/config)", envName("no-color"))
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Content holds the fields rmtree uses from a document's .content file.
+type Content struct {
+	FileType  string   `json:"fileType"`
+	PageCount int      `json:"pageCount"`
+	Pages     []string `json:"pages"`
+	Tags      []struct {
+		Name string `json:"name"`
+	} `json:"tags"`
+	CPages struct {
+		Pages []struct {
+			ID  string `json:"id"`
+			Idx struct {
+				Value string `json:"value"`
+			} `json:"idx"`
+			Deleted *struct {
+				Value int `json:"value"`
+			} `json:"deleted"`
+		} `json:"pages"`
+	} `json:"cPages"`
+}
+
+// readContent reads <uuid>.content from the xochitl directory.
+func readContent(remarkablePath, uuid string) (*Content, error) {
+	data, err := fs.ReadFile(sourceFS(remarkablePath), uuid+".content")
+	if err != nil {
+		return nil, err
+	}
+
+	var content Content
+	if err := json.Unmarshal(data, &content); err != nil {
+		return nil, err
+	}
+	return &content, nil
+}
+
+// importedExt matches a file extension left in a document name by the import,
+// as in "Saga 01.cbz".
+var importedExt = regexp.MustCompile(`\.([A-Za-z0-9]{1,5})$`)
+
+// importFormats are the extensions of files the tablet and the reMarkable apps
+// import, either as they are or converted to pdf.
+var importFormats = map[string]bool{
+	"pdf": true, "epub": true,
+	"cbz": true, "cbr": true, "mobi": true, "docx": true,
+	"png": true, "jpg": true, "jpeg": true,
+}
+
+// originalExtension returns the lowercase extension of the file a document was
+// imported from. The tablet converts formats such as cbz to pdf and keeps only
+// the converted fileType in .content, so a known import format still in the
+// name takes precedence. Other suffixes, as in "Report v2.1", are part of the
+// name.
+func originalExtension(item *Item, remarkablePath string) string {
+	if m := importedExt.FindStringSubmatch(item.Name); m != nil && importFormats[strings.ToLower(m[1])] {
+		return strings.ToLower(m[1])
+	}
+	if content, err := readContent(remarkablePath, item.UUID); err == nil && content.FileType != "" {
+		return strings.ToLower(content.FileType)
+	}
+	return item.DocType
+}
+
+// pageIDs returns the IDs of the document's pages in display order. Newer
+// firmware lists them in cPages, older firmware in pages.
+func (c *Content) pageIDs() []string {
+	if len(c.CPages.Pages) == 0 {
+		return c.Pages
+	}
+
+	pages := c.CPages.Pages
+	sort.SliceStable(pages, func(i, j int) bool {
+		return pages[i].Idx.Value < pages[j].Idx.Value
+	})
+
+	var ids []string
+	for _, page := range pages {
+		if page.Deleted != nil && page.Deleted.Value != 0 {
+			continue
+		}
+		ids = append(ids, page.ID)
+	}
+	return ids
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"sync"
+)
+
+// exportedFile is a document file written by a hardlink or copy export, kept
+// for --dedupe to find documents with the same content.
+type exportedFile struct {
+	// path is what later duplicates are hard linked to: the source in
+	// hardlink mode, the copy in copy mode. It is "" if the export failed.
+	path string
+	// done is closed once the export has finished and path is set
+	done chan struct{}
+}
+
+// contentIndex finds exported files with the same content as a source file.
+// An entry is reserved before its file is exported, so that with
+// --export-jobs a duplicate transferred at the same time waits for it rather
+// than being exported on its own.
+type contentIndex struct {
+	mu     sync.Mutex
+	byHash map[string]*exportedFile
+	saved  int64
+	linked int
+}
+
+// reserve looks up the file exported with the same content as src. If there
+// is one, it waits for its export to finish and returns its path, or "" if
+// that export failed. Otherwise it returns a pending entry, which the caller
+// must finish once it has exported src. Neither is returned if src can't be
+// read.
+func (c *contentIndex) reserve(src string) (string, *exportedFile) {
+	hash := fileHash(src)
+	if hash == "" {
+		return "", nil
+	}
+
+	c.mu.Lock()
+	f, ok := c.byHash[hash]
+	if !ok {
+		if c.byHash == nil {
+			c.byHash = make(map[string]*exportedFile)
+		}
+		f = &exportedFile{done: make(chan struct{})}
+		c.byHash[hash] = f
+	}
+	c.mu.Unlock()
+
+	if !ok {
+		return "", f
+	}
+	<-f.done
+	return f.path, nil
+}
+
+// finish records the path a pending entry's file was exported to, or "" if
+// the export failed, and wakes up the duplicates waiting for it.
+func (f *exportedFile) finish(path string) {
+	f.path = path
+	close(f.done)
+}
+
+// linkedTo counts a document of the given size that was hard linked to an
+// identical one.
+func (c *contentIndex) linkedTo(size int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.saved += size
+	c.linked++
+}
+
+// fileHash returns the hex SHA-256 of a file's content, or "" if it can't be
+// read.
+func fileHash(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// updateMetadata rewrites a .metadata file, letting update modify its fields.
+// Fields rmtree does not know about are carried over untouched.
+func updateMetadata(remarkablePath, uuid string, update func(fields map[string]any)) error {
+	path := filepath.Join(remarkablePath, uuid+".metadata")
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	fields := make(map[string]any, len(raw))
+	for key, value := range raw {
+		fields[key] = value
+	}
+	update(fields)
+	fields["lastModified"] = strconv.FormatInt(time.Now().UnixMilli(), 10)
+	fields["metadatamodified"] = true
+
+	return writeJSONFile(path, fields)
+}
+
+// writeJSONFile writes v as indented JSON, replacing path atomically.
+func writeJSONFile(path string, v any) error {
+	data, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// runMoves re-parents items according to the --move and --move-from options.
+func runMoves(items map[string]*Item, children map[string][]*Item, config Config) error {
+	moves := config.Moves
+	if config.MoveFrom != "" {
+		fileMoves, err := readMoveFile(config.MoveFrom)
+		if err != nil {
+			return err
+		}
+		moves = append(moves, fileMoves...)
+	}
+
+	for _, move := range moves {
+		uuid, dest, ok := strings.Cut(move, ":")
+		if !ok {
+			return fmt.Errorf("invalid move '%s', expected UUID:DEST", move)
+		}
+
+		item, ok := items[uuid]
+		if !ok {
+			return fmt.Errorf("item '%s' not found", uuid)
+		}
+
+		folder, err := resolveFolder(dest, items, children)
+		if err != nil {
+			return err
+		}
+
+		parent, destName := "", "/"
+		if folder != nil {
+			parent = folder.UUID
+			destName = itemPath(folder, items)
+			for p, depth := folder, 0; p != nil && depth < 50; p, depth = items[p.Parent], depth+1 {
+				if p.UUID == item.UUID {
+					return fmt.Errorf("cannot move '%s' into itself or one of its subfolders", item.Name)
+				}
+			}
+		}
+
+		if !config.Yes {
+			fmt.Printf("Would move '%s' to '%s'\n", itemPath(item, items), destName)
+			continue
+		}
+
+		if err := updateMetadata(config.Path, item.UUID, func(fields map[string]any) {
+			fields["parent"] = parent
+		}); err != nil {
+			return fmt.Errorf("moving '%s': %w", item.Name, err)
+		}
+
+		fmt.Printf("Moved '%s' to '%s'\n", itemPath(item, items), destName)
+		item.Parent = parent
+	}
+
+	if !config.Yes {
+		return fmt.Errorf("refusing to modify metadata without --yes")
+	}
+	return nil
+}
+
+// readMoveFile reads UUID:DEST moves from a file, skipping blank lines and # comments.
+func readMoveFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var moves []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		moves = append(moves, line)
+	}
+	return moves, scanner.Err()
+}
+
+// runMkdirs creates the folders named by --mkdir, creating missing parents as needed.
+func runMkdirs(items map[string]*Item, children map[string][]*Item, config Config) error {
+	for _, path := range config.Mkdirs {
+		parent := "root"
+		created := false
+
+		for _, name := range strings.Split(strings.Trim(path, "/"), "/") {
+			if name == "" {
+				continue
+			}
+
+			var match *Item
+			for _, child := range children[parent] {
+				if child.Type != "CollectionType" || child.Name != name {
+					continue
+				}
+				if match != nil {
+					return fmt.Errorf("folder path '%s' is ambiguous", path)
+				}
+				match = child
+			}
+
+			if match == nil {
+				folder, err := createFolder(name, parent, config)
+				if err != nil {
+					return fmt.Errorf("creating folder '%s': %w", name, err)
+				}
+				items[folder.UUID] = folder
+				children[parent] = append(children[parent], folder)
+				match = folder
+				created = true
+
+				if config.Yes {
+					fmt.Printf("Created folder '%s'\n", itemPath(folder, items))
+				} else {
+					fmt.Printf("Would create folder '%s'\n", itemPath(folder, items))
+				}
+			}
+			parent = match.UUID
+		}
+
+		if !created {
+			return fmt.Errorf("folder '%s' already exists", path)
+		}
+	}
+
+	if !config.Yes {
+		return fmt.Errorf("refusing to modify metadata without --yes")
+	}
+	return nil
+}
+
+// createFolder writes the .metadata and .content files for a new folder.
+// Without --yes nothing is written and only the in-memory item is returned.
+func createFolder(name, parent string, config Config) (*Item, error) {
+	uuid, err := newUUID()
+	if err != nil {
+		return nil, err
+	}
+
+	folder := &Item{
+		UUID:    uuid,
+		Name:    name,
+		Type:    "CollectionType",
+		Parent:  parent,
+		SortKey: "0|" + name,
+	}
+	if parent == "root" {
+		folder.Parent = ""
+	}
+
+	if !config.Yes {
+		return folder, nil
+	}
+
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	metadata := map[string]any{
+		"createdTime":      now,
+		"deleted":          false,
+		"lastModified":     now,
+		"metadatamodified": true,
+		"modified":         false,
+		"parent":           folder.Parent,
+		"pinned":           false,
+		"synced":           false,
+		"type":             "CollectionType",
+		"version":          0,
+		"visibleName":      name,
+	}
+	content := map[string]any{
+		"tags": []string{},
+	}
+
+	if err := writeJSONFile(filepath.Join(config.Path, uuid+".content"), content); err != nil {
+		return nil, err
+	}
+	if err := writeJSONFile(filepath.Join(config.Path, uuid+".metadata"), metadata); err != nil {
+		return nil, err
+	}
+	return folder, nil
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+// findOrphans returns the items whose parent folder doesn't exist, such as
+// after a partial sync, sorted like a folder's children.
+func findOrphans(items map[string]*Item) []*Item {
+	var orphans []*Item
+	for _, item := range items {
+		if _, ok := items[item.Parent]; !ok && item.Parent != "" && item.Parent != "trash" {
+			orphans = append(orphans, item)
+		}
+	}
+	sort.Slice(orphans, func(i, j int) bool {
+		return orphans[i].SortKey < orphans[j].SortKey
+	})
+	return orphans
+}
+
+// adoptOrphans moves the orphaned items into a synthetic Orphaned folder at
+// the end of the top level, so they are listed and exported instead of
+// silently left out, and warns about them.
+func adoptOrphans(items map[string]*Item) {
+	orphans := findOrphans(items)
+	if len(orphans) == 0 {
+		return
+	}
+
+	warnf("Warning: %d items have a missing parent folder, shown under Orphaned (see --orphans)\n", len(orphans))
+
+	items[orphanedUUID] = &Item{UUID: orphanedUUID, Name: "Orphaned", Type: "CollectionType", SortKey: "2|Orphaned"}
+	for _, item := range orphans {
+		item.Parent = orphanedUUID
+	}
+}
+
+// orphanedUUID identifies the synthetic Orphaned folder.
+const orphanedUUID = "orphaned"
+
+// runRepairOrphans lists the items whose parent folder no longer exists and,
+// with --yes, moves them to the root folder.
+func runRepairOrphans(items map[string]*Item, config Config) error {
+	orphans := findOrphans(items)
+	if len(orphans) == 0 {
+		fmt.Println("No orphaned items")
+		return nil
+	}
+
+	for _, item := range orphans {
+		if !config.Yes {
+			fmt.Printf("Orphaned '%s' [%s] (missing parent %s)\n", item.Name, item.UUID, item.Parent)
+			continue
+		}
+
+		if err := updateMetadata(config.Path, item.UUID, func(fields map[string]any) {
+			fields["parent"] = ""
+		}); err != nil {
+			return fmt.Errorf("repairing '%s': %w", item.Name, err)
+		}
+
+		fmt.Printf("Moved orphaned '%s' to '/'\n", item.Name)
+		item.Parent = ""
+	}
+
+	if !config.Yes {
+		fmt.Fprintln(os.Stderr, "Run again with --yes to move them to the root folder")
+	}
+	return nil
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// filterFields are the item fields a --filter expression can compare.
+var filterFields = map[string]string{
+	"name":    "string",
+	"docType": "string",
+	"pinned":  "string",
+	"tags":    "string",
+	"pages":   "number",
+	"size":    "number",
+	"date":    "date",
+}
+
+// filterExpr is a node of a parsed --filter expression.
+type filterExpr interface {
+	eval(item *filterItem) bool
+}
+
+type filterAnd struct{ left, right filterExpr }
+
+type filterOr struct{ left, right filterExpr }
+
+type filterCompare struct {
+	field  string
+	op     string
+	value  string
+	number float64
+	date   time.Time
+	re     *regexp.Regexp
+}
+
+func (e filterAnd) eval(item *filterItem) bool { return e.left.eval(item) && e.right.eval(item) }
+
+func (e filterOr) eval(item *filterItem) bool { return e.left.eval(item) || e.right.eval(item) }
+
+func (e filterCompare) eval(item *filterItem) bool {
+	switch filterFields[e.field] {
+	case "number":
+		value := item.number(e.field)
+		return compareOrdered(value, e.number, e.op) || e.op == "~=" && e.re.MatchString(strconv.FormatFloat(value, 'f', -1, 64))
+	case "date":
+		value := item.LastModified
+		switch e.op {
+		case "==":
+			return value.Format(time.DateOnly) == e.date.Format(time.DateOnly)
+		case "!=":
+			return value.Format(time.DateOnly) != e.date.Format(time.DateOnly)
+		case ">":
+			return value.After(e.date)
+		case "<":
+			return value.Before(e.date)
+		}
+		return e.re.MatchString(value.Format(time.RFC3339))
+	}
+
+	// Tags match if any tag does, and != holds only if no tag is equal
+	values := item.strings(e.field)
+	if e.op == "!=" {
+		for _, value := range values {
+			if value == e.value {
+				return false
+			}
+		}
+		return true
+	}
+	for _, value := range values {
+		if e.op == "~=" && e.re.MatchString(value) || compareOrdered(value, e.value, e.op) {
+			return true
+		}
+	}
+	return false
+}
+
+func compareOrdered[T string | float64](a, b T, op string) bool {
+	switch op {
+	case "==":
+		return a == b
+	case "!=":
+		return a != b
+	case ">":
+		return a > b
+	case "<":
+		return a < b
+	}
+	return false
+}
+
+// filterItem is an item being tested against a --filter expression. The
+// fields that need the .content file or a stat are read on first use.
+type filterItem struct {
+	*Item
+	remarkablePath string
+
+	content *Content
+	loaded  bool
+}
+
+func (item *filterItem) readContent() *Content {
+	if !item.loaded {
+		item.content, _ = readContent(item.remarkablePath, item.UUID)
+		item.loaded = true
+	}
+	return item.content
+}
+
+func (item *filterItem) number(field string) float64 {
+	switch field {
+	case "pages":
+		if content := item.readContent(); content != nil {
+			return float64(max(content.PageCount, len(content.pageIDs())))
+		}
+	case "size":
+		return float64(documentSize(item.Item, item.remarkablePath))
+	}
+	return 0
+}
+
+func (item *filterItem) strings(field string) []string {
+	switch field {
+	case "name":
+		return []string{item.Name}
+	case "docType":
+		return []string{item.DocType}
+	case "pinned":
+		return []string{strconv.FormatBool(item.Pinned)}
+	case "tags":
+		var tags []string
+		if content := item.readContent(); content != nil {
+			for _, tag := range content.Tags {
+				tags = append(tags, tag.Name)
+			}
+		}
+		return tags
+	}
+	return nil
+}
+
+// filterToken is a token of a --filter expression, with its 1-based column.
+type filterToken struct {
+	text   string
+	quoted bool
+	pos    int
+}
+
+var filterOperators = []string{"&&", "||", "==", "!=", "~=", ">", "<", "(", ")"}
+
+func tokenizeFilter(src string) ([]filterToken, error) {
+	var tokens []filterToken
+
+	for i := 0; i < len(src); {
+		c := src[i]
+		if c == ' ' || c == '\t' {
+			i++
+			continue
+		}
+
+		if c == '"' || c == '\'' {
+			end := strings.IndexByte(src[i+1:], c)
+			if end < 0 {
+				return nil, fmt.Errorf("position %d: unterminated string", i+1)
+			}
+			tokens = append(tokens, filterToken{text: src[i+1 : i+1+end], quoted: true, pos: i + 1})
+			i += end + 2
+			continue
+		}
+
+		operator := ""
+		for _, op := range filterOperators {
+			if strings.HasPrefix(src[i:], op) {
+				operator = op
+				break
+			}
+		}
+		if operator != "" {
+			tokens = append(tokens, filterToken{text: operator, pos: i + 1})
+			i += len(operator)
+			continue
+		}
+
+		start := i
+		for i < len(src) && !strings.ContainsRune(" \t\"'&|=!~<>()", rune(src[i])) {
+			i++
+		}
+		if i == start {
+			return nil, fmt.Errorf("position %d: unexpected '%c'", i+1, c)
+		}
+		tokens = append(tokens, filterToken{text: src[start:i], pos: start + 1})
+	}
+
+	return tokens, nil
+}
+
+// filterParser is a recursive descent parser over the tokens of an expression:
+//
+//	or      = and { "||" and }
+//	and     = primary { "&&" primary }
+//	primary = "(" or ")" | field op value
+type filterParser struct {
+	tokens []filterToken
+	next   int
+	end    int
+}
+
+// parseFilter parses a --filter expression. Errors give the position of the
+// offending token.
+func parseFilter(src string) (filterExpr, error) {
+	tokens, err := tokenizeFilter(src)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &filterParser{tokens: tokens, end: len(src) + 1}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.next < len(p.tokens) {
+		return nil, fmt.Errorf("position %d: unexpected '%s'", p.tokens[p.next].pos, p.tokens[p.next].text)
+	}
+	return expr, nil
+}
+
+func (p *filterParser) peek() (filterToken, bool) {
+	if p.next >= len(p.tokens) {
+		return filterToken{pos: p.end}, false
+	}
+	return p.tokens[p.next], true
+}
+
+func (p *filterParser) accept(text string) bool {
+	if token, ok := p.peek(); ok && !token.quoted && token.text == text {
+		p.next++
+		return true
+	}
+	return false
+}
+
+func (p *filterParser) parseOr() (filterExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = filterOr{left, right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (filterExpr, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		right, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		left = filterAnd{left, right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parsePrimary() (filterExpr, error) {
+	if p.accept("(") {
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(")") {
+			token, _ := p.peek()
+			return nil, fmt.Errorf("position %d: expected ')'", token.pos)
+		}
+		return expr, nil
+	}
+
+	field, ok := p.peek()
+	if !ok {
+		return nil, fmt.Errorf("position %d: expected a field name", field.pos)
+	}
+	kind, known := filterFields[field.text]
+	if field.quoted || !known {
+		return nil, fmt.Errorf("position %d: unknown field '%s'", field.pos, field.text)
+	}
+	p.next++
+
+	op, _ := p.peek()
+	if op.quoted || !isComparison(op.text) {
+		return nil, fmt.Errorf("position %d: expected ==, !=, >, < or ~= after '%s'", op.pos, field.text)
+	}
+	p.next++
+
+	value, ok := p.peek()
+	if !ok || !value.quoted && slices.Contains(filterOperators, value.text) {
+		return nil, fmt.Errorf("position %d: expected a value after '%s'", value.pos, op.text)
+	}
+	p.next++
+
+	compare := filterCompare{field: field.text, op: op.text, value: value.text}
+	var err error
+	switch {
+	case op.text == "~=":
+		compare.re, err = regexp.Compile(value.text)
+	case kind == "number":
+		compare.number, err = parseFilterNumber(value.text)
+	case kind == "date":
+		compare.date, err = parseFilterDate(value.text)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("position %d: %v", value.pos, err)
+	}
+	return compare, nil
+}
+
+func isComparison(op string) bool {
+	switch op {
+	case "==", "!=", ">", "<", "~=":
+		return true
+	}
+	return false
+}
+
+// parseFilterNumber parses a number with an optional K, M or G size suffix.
+func parseFilterNumber(s string) (float64, error) {
+	multiplier := 1.0
+	switch strings.ToUpper(s[max(len(s)-1, 0):]) {
+	case "K":
+		multiplier = 1 << 10
+	case "M":
+		multiplier = 1 << 20
+	case "G":
+		multiplier = 1 << 30
+	}
+	if multiplier != 1 {
+		s = s[:len(s)-1]
+	}
+
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number '%s'", s)
+	}
+	return n * multiplier, nil
+}
+
+// parseFilterDate parses a date as YYYY-MM-DD or RFC 3339.
+func parseFilterDate(s string) (time.Time, error) {
+	if t, err := time.ParseInLocation(time.DateOnly, s, time.Local); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid date '%s' (want YYYY-MM-DD)", s)
+}
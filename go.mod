@@ -2,4 +2,13 @@ module rmtree
 
 go 1.24.4
 
-require github.com/spf13/pflag v1.0.10 // indirect
+require (
+	github.com/pkg/sftp v1.13.9
+	github.com/spf13/pflag v1.0.10
+	golang.org/x/crypto v0.31.0
+)
+
+require (
+	github.com/kr/fs v0.1.0 // indirect
+	golang.org/x/sys v0.28.0 // indirect
+)
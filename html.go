@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ansiColors maps ANSI foreground color codes to CSS colors.
+var ansiColors = map[int]string{
+	30: "black", 31: "#c0392b", 32: "#27ae60", 33: "#b7950b",
+	34: "#2e86c1", 35: "#8e44ad", 36: "#17a2b8", 37: "gray",
+}
+
+// ansiCSS turns an ANSI escape sequence from colors into CSS declarations.
+func ansiCSS(seq string) string {
+	var decls []string
+	codes := strings.TrimSuffix(strings.TrimPrefix(seq, "\033["), "m")
+	for _, field := range strings.Split(codes, ";") {
+		code, err := strconv.Atoi(field)
+		switch {
+		case err != nil:
+		case code == 1:
+			decls = append(decls, "font-weight: bold")
+		case code >= 90 && code <= 97:
+			decls = append(decls, "color: "+ansiColors[code-60])
+		case ansiColors[code] != "":
+			decls = append(decls, "color: "+ansiColors[code])
+		}
+	}
+	return strings.Join(decls, "; ")
+}
+
+// printHTML writes the tree as a standalone HTML page. Folders are
+// <details> elements that expand and collapse, documents are styled with a
+// class per document type after the terminal colors, and documents with a PDF
+// or EPUB link to it.
+func printHTML(w io.Writer, items map[string]*Item, children map[string][]*Item, config Config) {
+	title := html.EscapeString(treeHeader(items, config))
+
+	fmt.Fprintf(w, "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>%s</title>\n<style>\n", title)
+	fmt.Fprintln(w, "body { font-family: sans-serif; }")
+	fmt.Fprintln(w, "ul { list-style: none; padding-left: 1.5em; }")
+	fmt.Fprintln(w, "summary { cursor: pointer; }")
+	fmt.Fprintln(w, "li a { color: inherit; }")
+	var classes []string
+	for class := range colors {
+		if class != "reset" && class != "highlight" {
+			classes = append(classes, class)
+		}
+	}
+	sort.Strings(classes)
+	for _, class := range classes {
+		fmt.Fprintf(w, ".%s { %s; }\n", class, ansiCSS(colors[class]))
+	}
+	fmt.Fprintf(w, "</style>\n</head>\n<body>\n<h1>%s</h1>\n<ul>\n", title)
+
+	roots, trashItems := topLevel(children, config)
+	for _, item := range roots {
+		printHTMLItem(w, item, 1, children, config)
+	}
+	if len(trashItems) > 0 {
+		trash := &Item{UUID: "trash", Name: "Trash", Type: "CollectionType"}
+		printHTMLItem(w, trash, 1, map[string][]*Item{"trash": trashItems}, config)
+	}
+
+	fmt.Fprintln(w, "</ul>\n</body>\n</html>")
+}
+
+func printHTMLItem(w io.Writer, item *Item, depth int, children map[string][]*Item, config Config) {
+	if depth > 50 {
+		return
+	}
+
+	indent := strings.Repeat("  ", depth)
+	name := html.EscapeString(displayName(item, config))
+
+	if item.Type != "CollectionType" {
+		if path := backingFile(item, config.Path); path != "" {
+			href := (&url.URL{Path: filepath.ToSlash(path)}).String()
+			name = fmt.Sprintf("<a href=\"%s\">%s</a>", html.EscapeString(href), name)
+		}
+		fmt.Fprintf(w, "%s<li class=\"%s\">%s</li>\n", indent, html.EscapeString(item.DocType), name)
+		return
+	}
+
+	itemChildren := children[item.UUID]
+	if len(itemChildren) == 0 || (config.Depth > 0 && depth >= config.Depth) {
+		fmt.Fprintf(w, "%s<li class=\"folder\">%s</li>\n", indent, name)
+		return
+	}
+
+	fmt.Fprintf(w, "%s<li><details><summary class=\"folder\">%s</summary>\n%s<ul>\n", indent, name, indent)
+	for _, child := range itemChildren {
+		printHTMLItem(w, child, depth+1, children, config)
+	}
+	fmt.Fprintf(w, "%s</ul></details></li>\n", indent)
+}
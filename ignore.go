@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ignoreFileName is the file of exclude patterns read from the working
+// directory and the xochitl directory unless --ignore-file is given.
+const ignoreFileName = ".rmtreeignore"
+
+// loadIgnorePatterns reads the glob patterns of --ignore-file, or of the
+// .rmtreeignore files in the working directory and remarkablePath.
+func loadIgnorePatterns(ignoreFile, remarkablePath string) ([]string, error) {
+	if ignoreFile != "" {
+		return readIgnoreFile(ignoreFile, true)
+	}
+
+	var patterns []string
+	for _, file := range []string{ignoreFileName, filepath.Join(remarkablePath, ignoreFileName)} {
+		filePatterns, err := readIgnoreFile(file, false)
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, filePatterns...)
+	}
+	return patterns, nil
+}
+
+// readIgnoreFile reads one pattern per line, skipping blank lines and #
+// comments. A missing file is an error only if required is set.
+func readIgnoreFile(file string, required bool) ([]string, error) {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) && !required {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var patterns []string
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		pattern := strings.TrimSpace(scanner.Text())
+		if pattern == "" || strings.HasPrefix(pattern, "#") {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid pattern '%s'", file, line, pattern)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, scanner.Err()
+}
+
+// ignored reports whether an item matches one of the patterns. Patterns
+// containing a slash are matched against the item's path from the top of its
+// tree, others against its name.
+func ignored(item *Item, items map[string]*Item, patterns []string) bool {
+	for _, pattern := range patterns {
+		subject := item.Name
+		if strings.Contains(pattern, "/") {
+			subject = itemPath(item, items)
+		}
+		if ok, _ := path.Match(pattern, subject); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// excludeIgnored drops the items matching the ignore patterns, along with
+// everything inside ignored folders.
+func excludeIgnored(items map[string]*Item, patterns []string) map[string]*Item {
+	kept := make(map[string]*Item)
+
+	for uuid, item := range items {
+		excluded := false
+		for p, depth := item, 0; p != nil && depth < 50; p, depth = items[p.Parent], depth+1 {
+			if ignored(p, items, patterns) {
+				excluded = true
+				break
+			}
+		}
+		if !excluded {
+			kept[uuid] = item
+		}
+	}
+
+	return kept
+}
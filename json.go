@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// printJSONByFolder prints an object mapping each folder path to the names of
+// the documents directly inside it. Documents at the top level are listed
+// under ".", and keys are sorted by encoding/json.
+func printJSONByFolder(w io.Writer, items map[string]*Item, children map[string][]*Item, config Config) error {
+	folders := map[string][]string{".": {}}
+	if len(children["trash"]) > 0 {
+		folders["Trash"] = []string{}
+	}
+
+	for _, item := range items {
+		if item.Type == "CollectionType" {
+			folders[formatPath(ancestorNames(item, items), config)] = []string{}
+		}
+	}
+
+	addDocuments := func(key, parent string) {
+		for _, child := range children[parent] {
+			if child.Type != "CollectionType" {
+				folders[key] = append(folders[key], child.Name)
+			}
+		}
+	}
+
+	addDocuments(".", "root")
+	addDocuments("Trash", "trash")
+	for _, item := range items {
+		if item.Type == "CollectionType" {
+			addDocuments(formatPath(ancestorNames(item, items), config), item.UUID)
+		}
+	}
+
+	return writeJSON(w, folders, config)
+}
+
+// librarySummary is the composition object printed by --summary-json.
+type librarySummary struct {
+	DocTypes  map[string]int `json:"docTypes"`
+	Documents int            `json:"documents"`
+	Folders   int            `json:"folders"`
+	Pages     int            `json:"pages"`
+	Bytes     int64          `json:"bytes"`
+	Trashed   int            `json:"trashed"`
+	MaxDepth  int            `json:"maxDepth"`
+}
+
+// printSummaryJSON prints counts per document type, totals of pages and bytes,
+// the number of trashed items and the deepest nesting level as one object.
+func printSummaryJSON(w io.Writer, items map[string]*Item, config Config) error {
+	summary := librarySummary{
+		DocTypes: map[string]int{"pdf": 0, "epub": 0, "notebook": 0},
+	}
+
+	for _, item := range items {
+		if topAncestor(item, items).Parent == "trash" {
+			summary.Trashed++
+		}
+		summary.MaxDepth = max(summary.MaxDepth, len(pathNames(item, items)))
+
+		if item.Type == "CollectionType" {
+			summary.Folders++
+			continue
+		}
+
+		summary.Documents++
+		summary.DocTypes[item.DocType]++
+		summary.Bytes += documentSize(item, config.Path)
+		if content, err := readContent(config.Path, item.UUID); err == nil {
+			summary.Pages += max(content.PageCount, len(content.pageIDs()))
+		}
+	}
+
+	return writeJSON(w, summary, config)
+}
+
+// documentSize returns the size in bytes of a document's backing file and
+// page files.
+func documentSize(item *Item, remarkablePath string) int64 {
+	fsys := sourceFS(remarkablePath)
+	var size int64
+	if item.Ext != "" {
+		if info, err := fs.Stat(fsys, item.UUID+"."+item.Ext); err == nil {
+			size += info.Size()
+		}
+	}
+
+	pages, _ := fs.ReadDir(fsys, item.UUID)
+	for _, page := range pages {
+		if info, err := page.Info(); err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+	}
+	return size
+}
+
+// jsonNode is an item in the --json output.
+type jsonNode struct {
+	UUID    string `json:"uuid"`
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	DocType string `json:"docType"`
+	*jsonDates
+	Children  []jsonNode `json:"children"`
+	Truncated bool       `json:"truncated,omitempty"`
+}
+
+// jsonDates are the --json-relative-dates fields of a node, null for items
+// without a timestamp.
+type jsonDates struct {
+	LastModified *string `json:"lastModified"`
+	ModifiedAgo  *string `json:"modifiedAgo"`
+}
+
+func newJSONDates(t time.Time, now time.Time) *jsonDates {
+	dates := &jsonDates{}
+	if t.IsZero() {
+		return dates
+	}
+	modified := t.UTC().Format(time.RFC3339)
+	ago := formatAgo(now.Sub(t))
+	dates.LastModified = &modified
+	dates.ModifiedAgo = &ago
+	return dates
+}
+
+// formatAgo describes how long ago something happened in the largest whole
+// unit, such as "3 days ago".
+func formatAgo(d time.Duration) string {
+	units := []struct {
+		name string
+		size time.Duration
+	}{
+		{"year", 365 * 24 * time.Hour},
+		{"month", 30 * 24 * time.Hour},
+		{"day", 24 * time.Hour},
+		{"hour", time.Hour},
+		{"minute", time.Minute},
+	}
+	for _, unit := range units {
+		n := int(d / unit.size)
+		if n == 1 {
+			return "1 " + unit.name + " ago"
+		}
+		if n > 1 {
+			return fmt.Sprintf("%d %ss ago", n, unit.name)
+		}
+	}
+	return "just now"
+}
+
+// jsonTree is the document printed by --json.
+type jsonTree struct {
+	Tablet   string     `json:"tablet"`
+	RootPath string     `json:"rootPath,omitempty"`
+	Root     []jsonNode `json:"root"`
+	Trash    []jsonNode `json:"trash"`
+	Rendered *string    `json:"rendered,omitempty"`
+}
+
+// printJSON prints the tree as nested nodes, with the top-level items under
+// "root" and the trashed ones under "trash". "tablet" holds --name, or the
+// name of the xochitl directory, and with --show-parents and --root
+// "rootPath" holds the path of the root folder. With --json-relative-dates each node also
+// has its last modified time and how long ago that was, and with
+// --json-with-render "rendered" holds the text tree and summary without
+// colors. --json-depth leaves out the children of folders below that many
+// levels and marks them "truncated"; --depth doesn't apply. No summary is
+// printed.
+func printJSON(w io.Writer, items map[string]*Item, children map[string][]*Item, config Config) error {
+	return writeJSON(w, newJSONTree(items, children, config), config)
+}
+
+func newJSONTree(items map[string]*Item, children map[string][]*Item, config Config) jsonTree {
+	now := time.Now()
+
+	var nodes func(list []*Item, depth int) []jsonNode
+	nodes = func(list []*Item, depth int) []jsonNode {
+		result := []jsonNode{}
+		if depth > 50 {
+			return result
+		}
+		for _, item := range list {
+			node := jsonNode{
+				UUID:     item.UUID,
+				Name:     item.Name,
+				Type:     item.Type,
+				DocType:  item.DocType,
+				Children: []jsonNode{},
+			}
+			if config.JSONDepth > 0 && depth+1 >= config.JSONDepth {
+				node.Truncated = len(children[item.UUID]) > 0
+			} else {
+				node.Children = nodes(children[item.UUID], depth+1)
+			}
+			if config.RelativeDates {
+				node.jsonDates = newJSONDates(item.LastModified, now)
+			}
+			result = append(result, node)
+		}
+		return result
+	}
+
+	roots, trashItems := topLevel(children, config)
+	tablet := config.Name
+	if tablet == "" {
+		tablet = filepath.Base(config.Path)
+	}
+
+	tree := jsonTree{Tablet: tablet, Root: nodes(roots, 0), Trash: nodes(trashItems, 0)}
+	if config.ShowParents && config.Root != "" {
+		tree.RootPath = treeHeader(items, config)
+	}
+
+	if config.JSONWithRender {
+		rendered := renderPlain(items, children, config)
+		tree.Rendered = &rendered
+	}
+	return tree
+}
+
+// flatNode is a jsonNode without its children, with the UUID of its parent
+// node ("root" or "trash" at the top level) and its path from the top.
+type flatNode struct {
+	Name, Type, DocType, Parent, Path string
+}
+
+// flatten indexes the nodes of a --json tree by UUID.
+func (tree jsonTree) flatten() map[string]flatNode {
+	flat := make(map[string]flatNode)
+	var walk func(nodes []jsonNode, parent, path string)
+	walk = func(nodes []jsonNode, parent, path string) {
+		for _, node := range nodes {
+			nodePath := node.Name
+			if path != "" {
+				nodePath = path + "/" + node.Name
+			}
+			flat[node.UUID] = flatNode{node.Name, node.Type, node.DocType, parent, nodePath}
+			walk(node.Children, node.UUID, nodePath)
+		}
+	}
+	walk(tree.Root, "root", "")
+	walk(tree.Trash, "trash", "Trash")
+	return flat
+}
+
+// compareJSON renders the tree as --json would and prints the items that were
+// added, removed or changed compared to a previously saved --json file,
+// matching them by UUID. An item has changed if its name, type, document
+// type or parent differs. Returns an error if there are any differences.
+func compareJSON(w io.Writer, file string, items map[string]*Item, children map[string][]*Item, config Config) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var saved jsonTree
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("reading JSON file '%s': %w", file, err)
+	}
+
+	previous := saved.flatten()
+	current := newJSONTree(items, children, config).flatten()
+
+	var lines []string
+	for uuid, node := range current {
+		old, ok := previous[uuid]
+		if !ok {
+			lines = append(lines, fmt.Sprintf("added    %s  %s", uuid, node.Path))
+			continue
+		}
+		var changes []string
+		if old.Name != node.Name {
+			changes = append(changes, fmt.Sprintf("name %q -> %q", old.Name, node.Name))
+		}
+		if old.Type != node.Type {
+			changes = append(changes, fmt.Sprintf("type %s -> %s", old.Type, node.Type))
+		}
+		if old.DocType != node.DocType {
+			changes = append(changes, fmt.Sprintf("docType %s -> %s", old.DocType, node.DocType))
+		}
+		if old.Parent != node.Parent {
+			from := "the top level"
+			if dir := path.Dir(old.Path); dir != "." {
+				from = dir
+			}
+			changes = append(changes, "moved from "+from)
+		}
+		if len(changes) > 0 {
+			lines = append(lines, fmt.Sprintf("changed  %s  %s (%s)", uuid, node.Path, strings.Join(changes, ", ")))
+		}
+	}
+	for uuid, old := range previous {
+		if _, ok := current[uuid]; !ok {
+			lines = append(lines, fmt.Sprintf("removed  %s  %s", uuid, old.Path))
+		}
+	}
+
+	sort.Strings(lines)
+	for _, line := range lines {
+		fmt.Fprintln(w, line)
+	}
+	if len(lines) > 0 {
+		return fmt.Errorf("tree differs from '%s' in %d places", file, len(lines))
+	}
+	return nil
+}
+
+// renderPlain returns the text tree and summary line as printed without
+// colors or thumbnails.
+func renderPlain(items map[string]*Item, children map[string][]*Item, config Config) string {
+	config.UseColor = false
+	config.Thumbnails = false
+
+	var b bytes.Buffer
+	var dirCount, fileCount int
+	if config.Compact {
+		dirCount, fileCount = renderCompactTree(&b, items, children, config)
+	} else {
+		dirCount, fileCount = renderTree(&b, items, children, config)
+	}
+	fmt.Fprintf(&b, "\n%s\n", formatSummary(dirCount, fileCount, onlyTypeCounts(items, children, config), config))
+
+	return ansiEscape.ReplaceAllString(b.String(), "")
+}
+
+// writeJSON prints v as indented JSON. Maps are always written with sorted
+// keys; with --sort-keys the fields of structs are sorted too, so the output
+// doesn't depend on the order fields were added to rmtree.
+func writeJSON(w io.Writer, v any, config Config) error {
+	if config.SortKeys {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		if err := decoder.Decode(&v); err != nil {
+			return err
+		}
+	}
+
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(w, string(data))
+	return nil
+}
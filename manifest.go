@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// readIDMap reads the path to UUID records written by --write-idmap. Records
+// end in a newline, or a NUL byte with --null. The name in the last field is
+// skipped; maps from older versions of rmtree have only path and UUID.
+func readIDMap(path string, config Config) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	terminator := "\n"
+	if config.Null {
+		terminator = "\x00"
+	}
+
+	records := make(map[string]string)
+	for i, record := range strings.Split(string(data), terminator) {
+		if record == "" {
+			continue
+		}
+		sep := strings.LastIndexByte(record, '\t')
+		if sep < 0 {
+			return nil, fmt.Errorf("%s: record %d has no tab", path, i+1)
+		}
+		if uuidSep := strings.LastIndexByte(record[:sep], '\t'); uuidSep >= 0 {
+			sep, record = uuidSep, record[:sep]
+		}
+		records[record[:sep]] = record[sep+1:]
+	}
+	return records, nil
+}
+
+// generatedFile matches the files rmtree writes next to the documents it
+// exports: cover thumbnails, and the page SVGs and thumbnails of notebooks.
+var generatedFile = regexp.MustCompile(`(\.cover\.png|^page-[0-9]{3,}\.(svg|png))$`)
+
+// verifyManifest checks the export below --output against an id map: every
+// recorded path must still exist and, if it is a symbolic link, point at the
+// document with the recorded UUID. Files that aren't recorded are reported as
+// added, except for the id map itself and the files matching generatedFile.
+func verifyManifest(w io.Writer, manifestPath string, config Config) error {
+	records, err := readIDMap(manifestPath, config)
+	if err != nil {
+		return fmt.Errorf("reading manifest: %w", err)
+	}
+	manifestInfo, err := os.Stat(manifestPath)
+	if err != nil {
+		return fmt.Errorf("reading manifest: %w", err)
+	}
+
+	var problems []string
+	for path, uuid := range records {
+		dest := filepath.Join(config.OutputPath, path)
+		fi, err := os.Lstat(dest)
+		if err != nil {
+			problems = append(problems, "removed  "+path)
+			continue
+		}
+		if fi.Mode()&fs.ModeSymlink == 0 {
+			continue // Copies made by --fallback-copy can't be traced to a UUID
+		}
+		target, _ := os.Readlink(dest)
+		if !strings.HasPrefix(filepath.Base(target), uuid+".") {
+			problems = append(problems, "changed  "+path+" -> "+target)
+		}
+	}
+
+	err = filepath.WalkDir(config.OutputPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if generatedFile.MatchString(d.Name()) {
+			return nil
+		}
+		if fi, err := os.Stat(path); err == nil && os.SameFile(fi, manifestInfo) {
+			return nil
+		}
+		rel, err := filepath.Rel(config.OutputPath, path)
+		if err != nil {
+			return err
+		}
+		if _, ok := records[rel]; !ok {
+			problems = append(problems, "added    "+rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Strings(problems)
+	for _, problem := range problems {
+		fmt.Fprintln(w, problem)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("export differs from manifest in %d places", len(problems))
+	}
+	return nil
+}
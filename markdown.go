@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// markdownEscaper escapes the characters that would turn a name into
+// Markdown formatting or a link.
+var markdownEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `_`, `\_`, `[`, `\[`, `]`, `\]`, "`", "\\`")
+
+// printMarkdown writes the tree as a nested Markdown list, indented by two
+// spaces per level, with folders in bold. With --uuid documents link to their
+// files in the xochitl directory. With --show-parents and --root the list is
+// headed by the path of the root folder.
+func printMarkdown(w io.Writer, items map[string]*Item, children map[string][]*Item, config Config) {
+	if config.ShowParents && config.Root != "" {
+		fmt.Fprintf(w, "# %s\n\n", markdownEscaper.Replace(treeHeader(items, config)))
+	}
+
+	roots, trashItems := topLevel(children, config)
+
+	for _, item := range roots {
+		printMarkdownItem(w, item, 0, children, config)
+	}
+
+	if len(trashItems) > 0 {
+		trash := &Item{UUID: "trash", Name: "Trash", Type: "CollectionType"}
+		printMarkdownItem(w, trash, 0, map[string][]*Item{"trash": trashItems}, config)
+	}
+}
+
+func printMarkdownItem(w io.Writer, item *Item, depth int, children map[string][]*Item, config Config) {
+	if depth > 50 {
+		return
+	}
+
+	indent := strings.Repeat("  ", depth)
+	name := markdownEscaper.Replace(displayName(item, config))
+
+	switch {
+	case item.Type == "CollectionType":
+		fmt.Fprintf(w, "%s- **%s**\n", indent, name)
+	case config.ShowUUID:
+		target := item.UUID
+		if item.Ext != "" {
+			target += "." + item.Ext
+		}
+		fmt.Fprintf(w, "%s- [%s](%s)\n", indent, name, target)
+	default:
+		fmt.Fprintf(w, "%s- %s\n", indent, name)
+	}
+
+	if config.Depth > 0 && depth+1 >= config.Depth {
+		return
+	}
+	for _, child := range children[item.UUID] {
+		printMarkdownItem(w, child, depth+1, children, config)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// exportNotebookPages converts each page of a notebook to SVG with the
+// --rm-converter command, writing page-001.svg, page-002.svg, ... into relDir
+// below the output path.
+func exportNotebookPages(item *Item, relDir string, config Config, state *linkState) {
+	template := strings.Fields(config.RMConverter)
+	if state.converterMissing {
+		return
+	}
+	if _, err := exec.LookPath(template[0]); err != nil {
+		warnf("Warning: notebook converter '%s' not found, skipping notebooks\n", template[0])
+		state.converterMissing = true
+		return
+	}
+
+	content, err := readContent(config.Path, item.UUID)
+	if err != nil {
+		warnf("Warning: skipping notebook '%s': %v\n", item.Name, err)
+		return
+	}
+
+	pages := content.pageIDs()
+	if len(pages) == 0 {
+		return
+	}
+
+	dir := filepath.Join(config.OutputPath, relDir)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		warnf("Error creating directory '%s': %v\n", dir, err)
+		return
+	}
+
+	for i, page := range pages {
+		src := filepath.Join(config.Path, item.UUID, page+".rm")
+		if _, err := os.Stat(src); err != nil {
+			continue // Pages that were never written on have no .rm file
+		}
+		dst := filepath.Join(dir, fmt.Sprintf("page-%03d.svg", i+1))
+
+		args := make([]string, len(template))
+		for j, arg := range template {
+			arg = strings.ReplaceAll(arg, "{src}", src)
+			arg = strings.ReplaceAll(arg, "{dst}", dst)
+			arg = strings.ReplaceAll(arg, "{page}", strconv.Itoa(i+1))
+			args[j] = arg
+		}
+
+		cmd := exec.Command(args[0], args[1:]...)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			warnf("Error converting page %d of '%s': %v\n%s", i+1, item.Name, err, output)
+			state.fail(filepath.Join(relDir, filepath.Base(dst)), err.Error())
+			continue
+		}
+		if config.Verbose {
+			fmt.Fprintf(os.Stderr, "Converted '%s'\n", filepath.Join(relDir, filepath.Base(dst)))
+		}
+	}
+}
+
+// exportPageThumbnails copies the thumbnails xochitl keeps of a notebook's
+// pages into relDir below the output path as page-001.png, page-002.png, ...
+// Pages without a thumbnail are skipped.
+func exportPageThumbnails(item *Item, relDir string, config Config, state *linkState) {
+	content, err := readContent(config.Path, item.UUID)
+	if err != nil {
+		return
+	}
+
+	thumbnails := filepath.Join(config.Path, item.UUID+".thumbnails")
+	for i, page := range content.pageIDs() {
+		src := filepath.Join(thumbnails, page+".png")
+		if _, err := os.Stat(src); err != nil {
+			continue
+		}
+
+		dir := filepath.Join(config.OutputPath, relDir)
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			warnf("Error creating directory '%s': %v\n", dir, err)
+			return
+		}
+
+		dst := filepath.Join(relDir, fmt.Sprintf("page-%03d.png", i+1))
+		if err := copyFile(src, filepath.Join(config.OutputPath, dst)); err != nil {
+			warnf("Error copying thumbnail '%s': %v\n", src, err)
+			state.fail(dst, err.Error())
+		}
+	}
+}
+
+// exportCoverThumbnail copies the thumbnail of a PDF or EPUB's first page next
+// to the exported document as "<name>.cover.png", if there is one.
+func exportCoverThumbnail(item *Item, relPath string, config Config, state *linkState) {
+	thumbnail := coverThumbnail(item, config.Path)
+	if thumbnail == "" {
+		return
+	}
+	src := filepath.Join(config.Path, thumbnail)
+
+	dst := strings.TrimSuffix(relPath, filepath.Ext(relPath)) + ".cover.png"
+	if err := copyFile(src, filepath.Join(config.OutputPath, dst)); err != nil {
+		warnf("Error copying thumbnail '%s': %v\n", src, err)
+		state.fail(dst, err.Error())
+	}
+}
+
+// renderNotebook runs the --render-cmd command to render a notebook to a PDF
+// at relPath below the output path. {uuid} is replaced with the notebook's
+// UUID, {src} with its page directory and {dst} with the PDF path. Failures
+// are reported and the export carries on.
+func renderNotebook(item *Item, relPath string, config Config, state *linkState) {
+	dst := filepath.Join(config.OutputPath, relPath)
+	err := runRenderCmd(item, dst, config, state)
+	if errors.Is(err, errRendererMissing) {
+		return
+	}
+	if err != nil {
+		warnf("Error rendering '%s': %v\n", item.Name, err)
+		state.fail(relPath, err.Error())
+		return
+	}
+	if _, err := os.Stat(dst); err != nil {
+		warnf("Error rendering '%s': %v\n", item.Name, err)
+		state.fail(relPath, "render command wrote no PDF")
+		return
+	}
+	if config.Verbose {
+		fmt.Fprintf(os.Stderr, "Rendered '%s'\n", relPath)
+	}
+	state.link(relPath, item)
+}
+
+// errRendererMissing is returned by runRenderCmd when the --render-cmd
+// command isn't installed, so nothing was rendered.
+var errRendererMissing = errors.New("render command not found")
+
+// runRenderCmd renders a notebook to dst with the --render-cmd command. A
+// missing command is reported once, after which every notebook is skipped
+// with errRendererMissing.
+func runRenderCmd(item *Item, dst string, config Config, state *linkState) error {
+	template := strings.Fields(config.RenderCmd)
+	if state.rendererMissing {
+		return errRendererMissing
+	}
+	if _, err := exec.LookPath(template[0]); err != nil {
+		warnf("Warning: render command '%s' not found, skipping notebooks\n", template[0])
+		state.rendererMissing = true
+		return errRendererMissing
+	}
+
+	replacer := strings.NewReplacer(
+		"{uuid}", item.UUID,
+		"{src}", filepath.Join(config.Path, item.UUID),
+		"{dst}", dst,
+	)
+	args := make([]string, len(template))
+	for i, arg := range template {
+		args[i] = replacer.Replace(arg)
+	}
+
+	output, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+	if err != nil && len(output) > 0 {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return err
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+)
+
+// resultPath returns the file or directory rmtree just produced: the output
+// folder in symlink mode, the --zip archive, the --tee file, or else the file
+// stdout was redirected to. It returns "" if there is none to open.
+func resultPath(config Config) string {
+	switch {
+	case config.SymLink:
+		return config.OutputPath
+	case config.ZipFile != "":
+		return config.ZipFile
+	case config.Tee != "":
+		return config.Tee
+	}
+
+	if fi, err := os.Stdout.Stat(); err == nil && fi.Mode().IsRegular() {
+		// Only Linux exposes the path of a redirected stdout this way
+		if path, err := os.Readlink("/proc/self/fd/1"); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// openResult launches the default application on target, the path returned
+// by resultPath.
+func openResult(target string) {
+	if target == "" {
+		warnf("Warning: --open has nothing to open, output was not written to a file\n")
+		return
+	}
+
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", target)
+	case "windows":
+		cmd = exec.Command("cmd", "/c", "start", "", target)
+	default:
+		cmd = exec.Command("xdg-open", target)
+	}
+
+	if err := cmd.Start(); err != nil {
+		warnf("Warning: could not open '%s': %v\n", target, err)
+	}
+}
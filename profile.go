@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/pprof"
+)
+
+// startProfiling starts the profiles requested with --cpuprofile and
+// --memprofile. The returned function stops them and writes the files.
+func startProfiling(config Config) (func(), error) {
+	var cpuFile *os.File
+	if config.CPUProfile != "" {
+		f, err := os.Create(config.CPUProfile)
+		if err != nil {
+			return nil, fmt.Errorf("creating CPU profile: %w", err)
+		}
+		if err := pprof.StartCPUProfile(f); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("starting CPU profile: %w", err)
+		}
+		cpuFile = f
+	}
+
+	return func() {
+		if cpuFile != nil {
+			pprof.StopCPUProfile()
+			cpuFile.Close()
+		}
+
+		if config.MemProfile != "" {
+			f, err := os.Create(config.MemProfile)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error creating memory profile: %v\n", err)
+				return
+			}
+			defer f.Close()
+
+			runtime.GC()
+			if err := pprof.WriteHeapProfile(f); err != nil {
+				fmt.Fprintf(os.Stderr, "Error writing memory profile: %v\n", err)
+			}
+		}
+	}, nil
+}
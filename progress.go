@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// progressEvery is how many steps pass between --progress-json events, so
+// large libraries don't flood the reader.
+const progressEvery = 50
+
+// progress reports --progress-json events, or is nil.
+var progress *progressReporter
+
+// progressReporter writes newline-delimited JSON progress events. All methods
+// do nothing on a nil reporter and are safe for concurrent use.
+type progressReporter struct {
+	w io.Writer
+
+	mu    sync.Mutex
+	phase string
+	done  int
+	total int
+}
+
+type progressEvent struct {
+	Phase string `json:"phase"`
+	Done  *int   `json:"done,omitempty"`
+	Total *int   `json:"total,omitempty"`
+}
+
+// start begins a phase of total steps.
+func (p *progressReporter) start(phase string, total int) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.phase, p.done, p.total = phase, 0, total
+	p.emit(progressEvent{Phase: phase, Done: &p.done, Total: &p.total})
+}
+
+// step records one finished step of the current phase.
+func (p *progressReporter) step() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.done++
+	if p.done%progressEvery == 0 || p.done == p.total {
+		p.emit(progressEvent{Phase: p.phase, Done: &p.done, Total: &p.total})
+	}
+}
+
+// finish reports that rmtree is done.
+func (p *progressReporter) finish() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.emit(progressEvent{Phase: "done"})
+}
+
+func (p *progressReporter) emit(event progressEvent) {
+	data, _ := json.Marshal(event)
+	fmt.Fprintln(p.w, string(data))
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// record is one line of --records output. Every field is always present;
+// those that don't apply or couldn't be read are null.
+type record struct {
+	Name         string  `json:"name"`
+	UUID         string  `json:"uuid"`
+	Parent       *string `json:"parent"`
+	Type         string  `json:"type"`
+	DocType      *string `json:"docType"`
+	Path         string  `json:"path"`
+	Depth        int     `json:"depth"`
+	Pinned       bool    `json:"pinned"`
+	Trashed      bool    `json:"trashed"`
+	LastModified *string `json:"lastModified"`
+	PageCount    *int    `json:"pageCount"`
+	Size         *int64  `json:"size"`
+}
+
+// printRecords writes one JSON object per line for every item, in tree order
+// with the trash last.
+func printRecords(w io.Writer, items map[string]*Item, children map[string][]*Item, config Config) error {
+	encoder := json.NewEncoder(w)
+
+	var walk func(list []*Item, depth int, trashed bool) error
+	walk = func(list []*Item, depth int, trashed bool) error {
+		if depth > 50 {
+			return nil
+		}
+		for _, item := range list {
+			if err := encoder.Encode(newRecord(item, depth, trashed, items, config)); err != nil {
+				return err
+			}
+			if err := walk(children[item.UUID], depth+1, trashed); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	roots, trashItems := topLevel(children, config)
+	if err := walk(roots, 0, false); err != nil {
+		return err
+	}
+	return walk(trashItems, 0, true)
+}
+
+func newRecord(item *Item, depth int, trashed bool, items map[string]*Item, config Config) record {
+	r := record{
+		Name:    item.Name,
+		UUID:    item.UUID,
+		Type:    item.Type,
+		Path:    formatPath(ancestorNames(item, items), config),
+		Depth:   depth,
+		Pinned:  item.Pinned,
+		Trashed: trashed,
+	}
+
+	if item.Parent != "" {
+		r.Parent = &item.Parent
+	}
+	if !item.LastModified.IsZero() {
+		modified := item.LastModified.UTC().Format(time.RFC3339)
+		r.LastModified = &modified
+	}
+	if item.Type == "CollectionType" {
+		return r
+	}
+
+	r.DocType = &item.DocType
+	if content, err := readContent(config.Path, item.UUID); err == nil {
+		pages := max(content.PageCount, len(content.pageIDs()))
+		r.PageCount = &pages
+	}
+	if size := documentSize(item, config.Path); size > 0 {
+		r.Size = &size
+	}
+	return r
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// printDuplicateNames lists names used by more than one item, with the
+// folders they appear in, most repeated first.
+func printDuplicateNames(w io.Writer, items map[string]*Item, config Config) {
+	byName := make(map[string][]*Item)
+	for _, item := range items {
+		byName[item.Name] = append(byName[item.Name], item)
+	}
+
+	var names []string
+	for name, matches := range byName {
+		if len(matches) > 1 {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if len(byName[names[i]]) != len(byName[names[j]]) {
+			return len(byName[names[i]]) > len(byName[names[j]])
+		}
+		return names[i] < names[j]
+	})
+
+	for _, name := range names {
+		var folders []string
+		for _, item := range byName[name] {
+			folder := "."
+			if parent, ok := items[item.Parent]; ok {
+				folder = formatPath(ancestorNames(parent, items), config) + config.PathSep
+			} else if item.Parent == "trash" {
+				folder = "Trash" + config.PathSep
+			}
+			folders = append(folders, folder)
+		}
+		sort.Strings(folders)
+
+		fmt.Fprintf(w, "%s (×%d): %s\n", displayName(byName[name][0], config), len(byName[name]), strings.Join(folders, ", "))
+	}
+}
+
+// printWhereis prints the full path of the item with the given UUID, noting
+// whether it is in the trash or its parent folder is missing.
+func printWhereis(w io.Writer, uuid string, items map[string]*Item, config Config) error {
+	item, ok := items[uuid]
+	if !ok {
+		return fmt.Errorf("item '%s' not found", uuid)
+	}
+
+	names := pathNames(item, items)
+	path := formatPath(names, config)
+	if full := ancestorNames(item, items); len(full) > len(names) {
+		if full[0] == "Trash" {
+			path += " (trashed)"
+		} else {
+			path += " (orphaned)"
+		}
+	}
+
+	fmt.Fprintln(w, path)
+	return nil
+}
+
+// printFindName prints "UUID  path" for every item whose name contains query
+// (ignoring case), or equals it with --exact.
+func printFindName(w io.Writer, query string, items map[string]*Item, config Config) error {
+	var matches []*Item
+	for _, item := range items {
+		match := strings.Contains(strings.ToLower(item.Name), strings.ToLower(query))
+		if config.Exact {
+			match = item.Name == query
+		}
+		if match {
+			matches = append(matches, item)
+		}
+	}
+
+	if len(matches) == 0 {
+		return fmt.Errorf("no items named '%s'", query)
+	}
+
+	paths := make(map[*Item]string, len(matches))
+	for _, item := range matches {
+		paths[item] = formatPath(ancestorNames(item, items), config)
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return paths[matches[i]] < paths[matches[j]]
+	})
+
+	for _, item := range matches {
+		fmt.Fprintf(w, "%s  %s\n", item.UUID, paths[item])
+	}
+	return nil
+}
+
+// printOrphans lists the items whose parent folder is missing, with the UUID
+// of that folder.
+func printOrphans(w io.Writer, items map[string]*Item) {
+	orphans := findOrphans(items)
+	for _, item := range orphans {
+		fmt.Fprintf(w, "%s  %s  (missing parent %s)\n", item.UUID, item.Name, item.Parent)
+	}
+	fmt.Fprintf(w, "%d orphaned items\n", len(orphans))
+}
+
+// printTreeHash prints a SHA-256 digest of the path and type of every item,
+// which changes whenever anything is added, removed, renamed or moved. The
+// paths are sorted first so the digest doesn't depend on --sort.
+func printTreeHash(w io.Writer, items map[string]*Item) {
+	lines := make([]string, 0, len(items))
+	for _, item := range items {
+		docType := item.DocType
+		if item.Type == "CollectionType" {
+			docType = "folder"
+		}
+		lines = append(lines, ancestorPath(item, items)+"\x00"+docType+"\n")
+	}
+	sort.Strings(lines)
+
+	h := sha256.New()
+	for _, line := range lines {
+		io.WriteString(h, line)
+	}
+	fmt.Fprintf(w, "%x\n", h.Sum(nil))
+}
+
+// ageBuckets are the --age-report ranges, each holding the documents last
+// modified less than maxAge ago and not in an earlier bucket.
+var ageBuckets = []struct {
+	name   string
+	maxAge time.Duration
+}{
+	{"last week", 7 * 24 * time.Hour},
+	{"last month", 30 * 24 * time.Hour},
+	{"last 3 months", 90 * 24 * time.Hour},
+	{"last year", 365 * 24 * time.Hour},
+	{"older", math.MaxInt64},
+}
+
+// printAgeReport counts the documents and their total size by how long ago
+// they were last modified. Documents without a timestamp are counted as
+// (unknown).
+func printAgeReport(w io.Writer, items map[string]*Item, config Config) {
+	counts := make([]int, len(ageBuckets)+1)
+	sizes := make([]int64, len(ageBuckets)+1)
+	unknown := len(ageBuckets)
+
+	now := time.Now()
+	for _, item := range items {
+		if item.Type == "CollectionType" {
+			continue
+		}
+
+		bucket := unknown
+		if !item.LastModified.IsZero() {
+			age := now.Sub(item.LastModified)
+			bucket = 0
+			for age >= ageBuckets[bucket].maxAge {
+				bucket++
+			}
+		}
+		counts[bucket]++
+		sizes[bucket] += documentSize(item, config.Path)
+	}
+
+	for i, b := range ageBuckets {
+		fmt.Fprintf(w, "%-15s %6d  %10s\n", b.name, counts[i], formatSize(sizes[i]))
+	}
+	if counts[unknown] > 0 {
+		fmt.Fprintf(w, "%-15s %6d  %10s\n", "(unknown)", counts[unknown], formatSize(sizes[unknown]))
+	}
+}
+
+// formatSize returns a byte count in decimal units, such as "3.4 MB".
+func formatSize(bytes int64) string {
+	if bytes < 1000 {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	size := float64(bytes)
+	for _, unit := range []string{"kB", "MB", "GB", "TB"} {
+		size /= 1000
+		if size < 1000 || unit == "TB" {
+			return fmt.Sprintf("%.1f %s", size, unit)
+		}
+	}
+	return ""
+}
+
+// printStats prints an aligned table of the number of folders, documents of
+// each type, trashed items and all items.
+func printStats(w io.Writer, items map[string]*Item) {
+	counts := make(map[string]int)
+	folders, trashed := 0, 0
+	for _, item := range items {
+		if item.Type == "CollectionType" {
+			folders++
+		} else {
+			counts[item.DocType]++
+		}
+		if topAncestor(item, items).Parent == "trash" {
+			trashed++
+		}
+	}
+
+	docTypes := []string{"notebook", "pdf", "epub"}
+	var others []string
+	for docType := range counts {
+		if !slices.Contains(docTypes, docType) {
+			others = append(others, docType)
+		}
+	}
+	sort.Strings(others)
+
+	fmt.Fprintf(w, "%-10s %6d\n", "folders", folders)
+	for _, docType := range append(docTypes, others...) {
+		fmt.Fprintf(w, "%-10s %6d\n", docType, counts[docType])
+	}
+	fmt.Fprintf(w, "%-10s %6d\n", "trashed", trashed)
+	fmt.Fprintf(w, "%-10s %6d\n", "total", len(items))
+}
+
+// checkExists looks for an item named --exists or with the --exists-uuid UUID
+// and returns errNotFound if there is none. With --verbose the paths of the
+// matches are printed, otherwise it stops at the first one.
+func checkExists(w io.Writer, items map[string]*Item, config Config) error {
+	var paths []string
+	for _, item := range items {
+		if (config.Exists == "" || item.Name != config.Exists) && (config.ExistsUUID == "" || item.UUID != config.ExistsUUID) {
+			continue
+		}
+		paths = append(paths, formatPath(ancestorNames(item, items), config))
+		if !config.Verbose {
+			break
+		}
+	}
+
+	if len(paths) == 0 {
+		return errNotFound
+	}
+	if config.Verbose {
+		sort.Strings(paths)
+		for _, path := range paths {
+			fmt.Fprintln(w, path)
+		}
+	}
+	return nil
+}
+
+// printFind prints the full path of every item whose name matches, sorted.
+func printFind(w io.Writer, match func(name string) bool, items map[string]*Item, config Config) error {
+	var paths []string
+	for _, item := range items {
+		if match(item.Name) {
+			paths = append(paths, formatPath(ancestorNames(item, items), config))
+		}
+	}
+
+	if len(paths) == 0 {
+		return errNotFound
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		fmt.Fprintln(w, path)
+	}
+	return nil
+}
+
+// printRenderReport lists the documents that need rendering to be exported
+// in full: notebooks, and PDFs or EPUBs with pages written on. A count of each
+// and of the documents that can be exported as they are follows.
+func printRenderReport(w io.Writer, items map[string]*Item, config Config) {
+	var notebooks, annotated []string
+	passthrough := 0
+
+	for _, item := range items {
+		if item.Type == "CollectionType" {
+			continue
+		}
+		switch {
+		case item.Ext == "":
+			notebooks = append(notebooks, formatPath(ancestorNames(item, items), config))
+		case hasAnnotations(item, config.Path):
+			annotated = append(annotated, formatPath(ancestorNames(item, items), config))
+		default:
+			passthrough++
+		}
+	}
+	sort.Strings(notebooks)
+	sort.Strings(annotated)
+
+	for _, path := range notebooks {
+		fmt.Fprintf(w, "notebook   %s\n", path)
+	}
+	for _, path := range annotated {
+		fmt.Fprintf(w, "annotated  %s\n", path)
+	}
+
+	fmt.Fprintf(summaryOutput(config), "\n%d notebooks, %d annotated documents need rendering; %d documents can be exported as they are\n",
+		len(notebooks), len(annotated), passthrough)
+}
+
+// hasAnnotations reports whether a document has page files in its <uuid>
+// directory, meaning it has been written on.
+func hasAnnotations(item *Item, remarkablePath string) bool {
+	pages, err := fs.ReadDir(sourceFS(remarkablePath), item.UUID)
+	if err != nil {
+		return false
+	}
+	for _, page := range pages {
+		if filepath.Ext(page.Name()) == ".rm" {
+			return true
+		}
+	}
+	return false
+}
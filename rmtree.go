@@ -1,13 +1,28 @@
 package main
 
 import (
+	"archive/zip"
+	"bytes"
+	"cmp"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	pflag "github.com/spf13/pflag"
 )
@@ -15,19 +30,59 @@ import (
 var version = "dev"
 
 type Metadata struct {
-	VisibleName string `json:"visibleName"`
-	Type        string `json:"type"`
-	Parent      string `json:"parent"`
-	Deleted     bool   `json:"deleted"`
+	VisibleName  string    `json:"visibleName"`
+	Type         string    `json:"type"`
+	Parent       string    `json:"parent"`
+	Deleted      bool      `json:"deleted"`
+	LastModified Timestamp `json:"lastModified"`
+	Pinned       bool      `json:"pinned"`
+	LastOpened   Timestamp `json:"lastOpened"`
+	CreatedTime  Timestamp `json:"createdTime"`
+}
+
+// Timestamp is an epoch time from the metadata. Firmware versions store it as a
+// string or a number, in milliseconds or seconds.
+type Timestamp struct {
+	time.Time
+}
+
+func (t Timestamp) MarshalJSON() ([]byte, error) {
+	if t.IsZero() {
+		return []byte(`"0"`), nil
+	}
+	return []byte(`"` + strconv.FormatInt(t.UnixMilli(), 10) + `"`), nil
+}
+
+func (t *Timestamp) UnmarshalJSON(data []byte) error {
+	value, err := strconv.ParseInt(strings.Trim(string(data), `"`), 10, 64)
+	if err != nil || value <= 0 {
+		t.Time = time.Time{}
+		return nil
+	}
+	if value < 1e11 {
+		t.Time = time.Unix(value, 0)
+	} else {
+		t.Time = time.UnixMilli(value)
+	}
+	return nil
 }
 
 type Item struct {
-	UUID    string
-	Name    string
-	Type    string
-	Parent  string
-	DocType string
-	SortKey string
+	UUID         string
+	Name         string
+	Type         string
+	Parent       string
+	DocType      string
+	SortKey      string
+	Ext          string
+	Locked       bool
+	Empty        bool
+	PageCount    int
+	Size         int64 // bytes of the document's files, or of all documents in a folder
+	LastModified time.Time
+	LastOpened   time.Time
+	Pinned       bool
+	Created      time.Time
 }
 
 type Config struct {
@@ -38,6 +93,129 @@ type Config struct {
 	ShowUUID   bool
 	UseColor   bool
 	SymLink    bool
+	Moves      []string
+	MoveFrom   string
+	Mkdirs     []string
+	Yes        bool
+
+	SummaryStdout   bool
+	DetectEncrypted bool
+	EscapeNames     bool
+	Root            string
+	ShowParents     bool
+	Fields          []string
+
+	PathSep string
+
+	StateFile          string
+	ContentChangesOnly bool
+	PruneState         bool
+
+	PollInterval     time.Duration
+	FallbackCopy     bool
+	Verbose          bool
+	GroupByType      bool
+	DedupeNames      bool
+	BOM              bool
+	Verify           bool
+	Prune            bool
+	CPUProfile       string
+	MemProfile       string
+	NewerThan        string
+	JSONByFolder     bool
+	SkipSystem       bool
+	SystemNames      []string
+	IDMapFile        string
+	Null             bool
+	Compact          bool
+	CompactMax       int
+	Strict           bool
+	Numbers          bool
+	ExtMap           string
+	ExtTypes         map[string]string
+	Whereis          string
+	FindName         string
+	Exact            bool
+	Open             bool
+	RMConverter      string
+	Thumbnails       bool
+	PinnedFirst      bool
+	SummaryJSON      bool
+	OnCollision      string
+	SkipEmpty        bool
+	MarkEmpty        bool
+	WithPaths        bool
+	CacheFile        string
+	TSV              bool
+	NoHeader         bool
+	Filter           string
+	EOL              string
+	Only             []string
+	RepairOrphans    bool
+	ZipFile          string
+	ParentUUID       bool
+	Highlight        string
+	VerifyManifest   string
+	ExportThumbnails bool
+	FlatSort         string
+	IgnoreFile       string
+	IgnorePatterns   []string
+	JSON             bool
+	Depth            int
+	SortKeys         bool
+	Sort             string
+	Name             string
+	DirsOnly         bool
+	RenderReport     bool
+	Match            string
+	CaseSensitive    bool
+	SafeNames        bool
+	Copy             bool
+	Force            bool
+	Tee              string
+	RenderCmd        string
+	Pages            bool
+	ProgressJSON     bool
+	NoEmptyDirs      bool
+	SSH              string
+	Identity         string
+	NoTrash          bool
+	OnlyTrash        bool
+	OrigExt          []string
+	Favorites        bool
+	ShowPins         bool
+	Exists           string
+	ExistsUUID       string
+	Markdown         bool
+	ExportSince      string
+	Orphans          bool
+	TreeHash         bool
+	Jobs             int
+	Records          bool
+	HTML             bool
+	PruneMaxDepth    int
+	AgeReport        bool
+	Size             bool
+	NameField        string
+	LinkType         string
+	RelativeDates    bool
+	DryRun           bool
+	TrashSummary     bool
+	Dedupe           bool
+	Stats            bool
+	Quiet            bool
+	JSONWithRender   bool
+	ASCII            bool
+	Opened           bool
+	Color            string
+	FlatExport       bool
+	FlatSep          string
+	Find             string
+	FindRegex        string
+	CompareJSON      string
+	Created          bool
+	ExportJobs       int
+	JSONDepth        int
 }
 
 var colors = map[string]string{
@@ -45,53 +223,442 @@ var colors = map[string]string{
 	"pdf":    "\033[31m",
 	"epub":   "\033[32m",
 	"reset":  "\033[0m",
+
+	"highlight": "\033[1;7m",
 }
 
+// highlightPattern matches the names emphasized by --highlight, or is nil.
+var highlightPattern *regexp.Regexp
+
 func main() {
 	config := parseArgs()
 
-	if _, err := os.Stat(config.Path); os.IsNotExist(err) {
-		fmt.Fprintf(os.Stderr, "Error: Path '%s' does not exist\n", config.Path)
+	stopProfiling, err := startProfiling(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
 
+	code := execute(config)
+	stopProfiling()
+	os.Exit(code)
+}
+
+// execute checks the paths and runs rmtree, returning the process exit code.
+func execute(config Config) int {
+	if _, err := os.Stat(config.Path); config.SSH == "" && os.IsNotExist(err) {
+		fmt.Fprintf(os.Stderr, "Error: Path '%s' does not exist\n", config.Path)
+		return 1
+	}
+
 	if _, err := os.Stat(config.OutputPath); config.SymLink && os.IsNotExist(err) {
 		fmt.Fprintf(os.Stderr, "Error: Output Path '%s' does not exist\n", config.OutputPath)
-		os.Exit(1)
+		return 1
+	}
+
+	if config.Tee != "" {
+		f, err := os.Create(config.Tee)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+		defer f.Close()
+		teeFile = f
+	}
+
+	if config.BOM {
+		writeBOM(os.Stdout)
+		if teeFile != nil {
+			writeBOM(teeFile)
+		}
+	}
+
+	if config.PollInterval > 0 {
+		if err := pollTree(config); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	if config.ProgressJSON {
+		progress = &progressReporter{w: os.Stderr}
 	}
 
-	items, err := loadItems(config.Path)
+	err := run(config)
+	progress.finish()
+	if errors.Is(err, errNotFound) {
+		return 1
+	}
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error loading items: %v\n", err)
-		os.Exit(1)
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	// Open before checking --strict, so that its warnings count too
+	if config.Open {
+		openResult(resultPath(config))
+	}
+
+	if config.Strict && warnings.Load() > 0 {
+		fmt.Fprintf(os.Stderr, "Error: %d warnings reported (--strict)\n", warnings.Load())
+		return 1
+	}
+	return 0
+}
+
+// errNotFound is returned by run when --exists finds nothing. execute exits
+// with status 1 without printing an error.
+var errNotFound = errors.New("not found")
+
+// run loads the items and performs the operation selected by config.
+func run(config Config) error {
+	if config.VerifyManifest != "" {
+		return verifyManifest(stdoutWriter(config), config.VerifyManifest, config)
+	}
+
+	fsys, closeSource, err := openSource(config)
+	if err != nil {
+		return err
+	}
+	defer closeSource()
+	xochitlFS = fsys
+
+	var cache *MetadataCache
+	if config.CacheFile != "" {
+		source := config.Path
+		if config.SSH != "" {
+			source = config.SSH + ":" + config.Path
+		}
+		cache = loadCache(config.CacheFile, source)
+	}
+
+	items, err := loadItems(fsys, config.ExtTypes, cache, config.Jobs)
+	if err != nil {
+		return fmt.Errorf("loading items: %w", err)
+	}
+
+	if cache != nil {
+		if err := cache.save(config.CacheFile); err != nil {
+			warnf("Warning: could not write cache '%s': %v\n", config.CacheFile, err)
+		}
+	}
+
+	if config.DetectEncrypted {
+		detectLocked(items, config.Path)
+	}
+
+	if config.Pages {
+		loadPageCounts(items, config.Path)
+	}
+
+	if config.MarkEmpty || ((config.SymLink || config.ZipFile != "") && config.SkipEmpty) {
+		detectEmpty(items, config.Path)
+	}
+
+	if config.PinnedFirst {
+		pinnedFirst(items)
 	}
 
 	children := buildChildrenMap(items)
-	sortItems(items, children)
+	sortItems(items, children, config)
+
+	if len(config.Moves) > 0 || config.MoveFrom != "" {
+		return runMoves(items, children, config)
+	}
+
+	if config.RepairOrphans {
+		return runRepairOrphans(items, config)
+	}
+
+	if len(config.Mkdirs) > 0 {
+		return runMkdirs(items, children, config)
+	}
+
+	if config.StateFile != "" {
+		return runStateReport(stdoutWriter(config), items, config)
+	}
+
+	if config.Whereis != "" {
+		return printWhereis(stdoutWriter(config), config.Whereis, items, config)
+	}
+
+	if config.FindName != "" {
+		return printFindName(stdoutWriter(config), config.FindName, items, config)
+	}
+
+	if config.Find != "" {
+		query := strings.ToLower(config.Find)
+		return printFind(stdoutWriter(config), func(name string) bool {
+			return strings.Contains(strings.ToLower(name), query)
+		}, items, config)
+	}
+
+	if config.FindRegex != "" {
+		return printFind(stdoutWriter(config), regexp.MustCompile(config.FindRegex).MatchString, items, config)
+	}
+
+	if config.Orphans {
+		printOrphans(stdoutWriter(config), items)
+		return nil
+	}
+	adoptOrphans(items)
+
+	items, err = applyFilters(items, config)
+	if err != nil {
+		return err
+	}
+	children = buildChildrenMap(items)
+	sortItems(items, children, config)
+
+	if config.Size {
+		loadSizes(items, config.Path)
+	}
+
+	if config.AgeReport {
+		printAgeReport(stdoutWriter(config), items, config)
+		return nil
+	}
+
+	if config.TreeHash {
+		printTreeHash(stdoutWriter(config), items)
+		return nil
+	}
+
+	if config.Exists != "" || config.ExistsUUID != "" {
+		return checkExists(stdoutWriter(config), items, config)
+	}
+
+	if config.DedupeNames {
+		printDuplicateNames(stdoutWriter(config), items, config)
+		return nil
+	}
+
+	if config.JSONByFolder {
+		return printJSONByFolder(stdoutWriter(config), items, children, config)
+	}
+
+	if config.RenderReport {
+		printRenderReport(stdoutWriter(config), items, config)
+		return nil
+	}
+
+	if config.SummaryJSON {
+		return printSummaryJSON(stdoutWriter(config), items, config)
+	}
+
+	if config.Root != "" {
+		folder, err := resolveFolder(config.Root, items, children)
+		if err != nil {
+			return err
+		}
+		config.Root = ""
+		if folder != nil {
+			config.Root = folder.UUID
+		}
+	}
+
+	if config.CompareJSON != "" {
+		return compareJSON(stdoutWriter(config), config.CompareJSON, items, children, config)
+	}
+
+	if config.JSON {
+		return printJSON(stdoutWriter(config), items, children, config)
+	}
+
+	if config.Records {
+		return printRecords(stdoutWriter(config), items, children, config)
+	}
+
+	if config.HTML {
+		printHTML(stdoutWriter(config), items, children, config)
+		return nil
+	}
+
+	if config.Markdown {
+		printMarkdown(stdoutWriter(config), items, children, config)
+		return nil
+	}
+
+	if config.TSV {
+		printTSV(stdoutWriter(config), items, children, config)
+		return nil
+	}
+
+	if config.ZipFile != "" {
+		return zipTree(config.ZipFile, items, children, config)
+	}
 
 	if config.SymLink {
-		linkTree(items, children, config)
+		if err := linkTree(items, children, config); err != nil {
+			return err
+		}
+		if (config.Verify || config.Prune) && !config.DryRun {
+			return verifyLinks(config)
+		}
+	} else if config.Quiet && config.Stats {
+		printStats(stdoutWriter(config), items)
 	} else {
-		printTree(items, children, config)
+		if !config.Quiet {
+			printTree(stdoutWriter(config), items, children, config)
+		}
+		if config.Stats {
+			printStats(summaryOutput(config), items)
+		}
 	}
+	return nil
 }
 
 func parseArgs() Config {
 	config := Config{
-		Path:       "/home/root/.local/share/remarkable/xochitl",
-		OutputPath: ".",
-		UseColor:   true,
+		Path:        "/home/root/.local/share/remarkable/xochitl",
+		OutputPath:  ".",
+		OnCollision: "number",
+		SkipEmpty:   true,
+		EOL:         "lf",
+		FlatSort:    "tree",
+		Sort:        "name",
+		Jobs:        runtime.GOMAXPROCS(0),
+		ExportJobs:  1,
+		Color:       "auto",
+		FlatSep:     "_",
+		LinkType:    "symlink",
+		UseColor:    true,
 	}
 
 	pflag.BoolVarP(&config.ShowIcons, "icons", "i", false, "Show emoji icons")
 	pflag.BoolVarP(&config.ShowLabels, "labels", "l", false, "Show document type labels")
 	pflag.BoolVarP(&config.ShowUUID, "uuid", "u", false, "Show document UUIDs")
-	noColor := pflag.BoolP("no-color", "n", false, "Disable colored output")
+	noColor := pflag.BoolP("no-color", "n", false, "Disable colored output (same as --color never)")
+	pflag.StringVar(&config.Color, "color", config.Color, "When to color the output: auto (only on a terminal, unless NO_COLOR is set), always or never")
 	showVersion := pflag.BoolP("version", "v", false, "Show version information")
 	pflag.BoolVarP(&config.SymLink, "symlinks", "s", false, "Create symbolic links instead of printing")
 	pflag.StringVarP(&config.OutputPath, "output", "o", ".", "Output path for symbolic links")
+	pflag.BoolVar(&config.SummaryStdout, "summary-stdout", false, "Print the summary line to stdout instead of stderr")
+	pflag.BoolVar(&config.DetectEncrypted, "detect-encrypted", false, "Mark encrypted or unreadable documents as locked and skip them when linking")
+	pflag.BoolVar(&config.EscapeNames, "escape-names", false, "Escape control characters and ANSI codes in names (default on when stdout is a terminal)")
+	pflag.StringVar(&config.Root, "root", "", "Start the tree at a folder, given as a path or UUID")
+	pflag.BoolVar(&config.ShowParents, "show-parents", false, "Print the path above the --root folder as the tree header")
+	pflag.StringSliceVar(&config.Fields, "fields", []string{"name", "type", "pages", "opened", "created", "size", "uuid"}, "Order of the name and labels on each line ("+strings.Join(knownFields, ", ")+")")
+	pflag.StringVar(&config.PathSep, "path-sep", "/", "Separator used when printing full paths")
+	pflag.StringVar(&config.StateFile, "state", "", "Report documents added, changed, moved or removed since the last run recorded in this file")
+	pflag.BoolVar(&config.ContentChangesOnly, "content-changes-only", false, "With --state, only report content changes and skip moves and renames")
+	pflag.BoolVar(&config.PruneState, "prune-state", false, "With --state, forget removed documents instead of keeping them in the state file")
+	pflag.DurationVar(&config.PollInterval, "poll-interval", 0, "Keep running and re-render whenever the metadata changes, checking at this interval (e.g. 5s)")
+	pflag.BoolVar(&config.FallbackCopy, "fallback-copy", false, "Copy files when the output filesystem doesn't support symbolic links")
+	pflag.BoolVar(&config.Verbose, "verbose", false, "Print details about each operation")
+	pflag.BoolVar(&config.GroupByType, "group-by-type", false, "Group documents in each folder under [PDF], [EPUB] and [Notebooks] headings")
+	pflag.BoolVar(&config.DedupeNames, "dedupe-names", false, "List names used by more than one item and the folders they appear in")
+	pflag.BoolVar(&config.BOM, "bom", false, "Start output redirected to a new or empty file with a UTF-8 byte order mark")
+	pflag.BoolVar(&config.Verify, "verify", false, "After creating symbolic links, check that every link in the output resolves")
+	pflag.BoolVar(&config.Prune, "prune", false, "After creating symbolic links, remove dangling links from the output")
+	pflag.StringVar(&config.CPUProfile, "cpuprofile", "", "Write a CPU profile to this file")
+	pflag.StringVar(&config.MemProfile, "memprofile", "", "Write a memory profile to this file on exit")
+	pflag.StringVar(&config.NewerThan, "newer-than", "", "Only show documents modified after this file was last modified")
+	pflag.BoolVar(&config.JSONByFolder, "json-by-folder", false, "Print a JSON object mapping each folder path to the documents in it")
+	pflag.BoolVar(&config.SkipSystem, "skip-system", false, "Hide reMarkable system folders and documents at the top level")
+	pflag.StringSliceVar(&config.SystemNames, "system-names", defaultSystemNames, "Names or UUIDs hidden by --skip-system (implies --skip-system)")
+	pflag.StringVar(&config.IDMapFile, "write-idmap", "", "After creating symbolic links or a --zip archive, write the exported path, UUID and name of each document to this file")
+	pflag.BoolVarP(&config.Null, "null", "0", false, "End --write-idmap records with NUL instead of newline")
+	pflag.BoolVar(&config.Compact, "compact", false, "Print only folders, listing their documents inline")
+	pflag.IntVar(&config.CompactMax, "compact-max", 5, "With --compact, the number of documents listed per folder before \"...\" (0 for no limit)")
+	pflag.BoolVar(&config.Strict, "strict", false, "Exit non-zero if any warning was reported")
+	pflag.BoolVar(&config.Numbers, "numbers", false, "Prefix each line of the tree with its line number")
+	pflag.StringVar(&config.ExtMap, "ext-map", "", "Treat extra file extensions as a document type, e.g. cbz=pdf:mobi=epub")
+	pflag.StringVar(&config.Whereis, "whereis", "", "Print the full path of the item with this UUID and exit")
+	pflag.StringVar(&config.FindName, "find-name", "", "Print the UUID and full path of every item whose name contains this text")
+	pflag.BoolVar(&config.Exact, "exact", false, "With --find-name, only match names exactly")
+	pflag.BoolVar(&config.Open, "open", false, "Open the result with the default application when done (the output folder, --zip archive, --tee file, or the file stdout was redirected to)")
+	pflag.StringVar(&config.RMConverter, "rm-converter", "", "In symlink mode, convert notebook pages to SVG with this command ({src}, {dst} and {page} are replaced)")
+	pflag.BoolVar(&config.Thumbnails, "thumbnails", false, "Show document cover thumbnails as sixel images (needs a sixel-capable terminal)")
+	pflag.BoolVar(&config.PinnedFirst, "pinned-first", false, "Sort pinned items before the others in each folder")
+	pflag.BoolVar(&config.SummaryJSON, "summary-json", false, "Print the library composition (documents per type, pages, bytes, trashed, depth) as JSON instead of the tree")
+	pflag.StringVar(&config.OnCollision, "on-collision", config.OnCollision, "In symlink mode, what to do when two documents export to the same name: number, uuid, skip or overwrite")
+	pflag.BoolVar(&config.SkipEmpty, "skip-empty", config.SkipEmpty, "In symlink mode, skip documents whose backing file is empty (not yet downloaded)")
+	pflag.BoolVar(&config.MarkEmpty, "mark-empty", false, "Label documents whose backing file is empty")
+	pflag.BoolVar(&config.WithPaths, "with-paths", false, "Append a tab and the full path of the item to each tree line")
+	pflag.StringVar(&config.CacheFile, "cache", "", "Keep parsed metadata in this file and only re-read metadata files that changed")
+	pflag.BoolVar(&config.TSV, "tsv", false, "Print one tab-separated line per item (path, name, type, uuid, parent, modified) instead of the tree")
+	pflag.BoolVar(&config.NoHeader, "no-header", false, "Leave out the header line of --tsv")
+	pflag.StringVar(&config.Filter, "filter", "", "Only show documents matching this expression, e.g. 'docType==pdf && pages>50' (see README)")
+	pflag.StringVar(&config.EOL, "eol", config.EOL, "Line ending when output goes to a file or pipe: lf or crlf")
+	pflag.StringSliceVar(&config.Only, "only", nil, "Only show documents of these types (pdf, epub or notebook), comma separated")
+	pflag.BoolVar(&config.RepairOrphans, "repair-orphans", false, "List items whose parent folder is missing; with --yes, move them to the root folder")
+	pflag.StringVar(&config.ZipFile, "zip", "", "Write the documents into a zip archive laid out like the tree instead of printing it")
+	pflag.BoolVar(&config.ParentUUID, "parent-uuid", false, "Show the parent UUID of each item (root and trash shown as such)")
+	pflag.StringVar(&config.Highlight, "highlight", "", "Emphasize items whose name matches this text or regular expression (ignoring case)")
+	pflag.StringVar(&config.VerifyManifest, "verify-manifest", "", "Check the export in --output against an id map written by --write-idmap and report differences")
+	pflag.BoolVar(&config.ExportThumbnails, "export-thumbnails", false, "In symlink mode, copy notebook page thumbnails and PDF/EPUB cover thumbnails into the output")
+	pflag.StringVar(&config.FlatSort, "flat-sort", config.FlatSort, "Order of flat listings such as --tsv: tree (folder by folder) or path (by full path)")
+	pflag.StringVar(&config.IgnoreFile, "ignore-file", "", "Read exclude patterns from this file instead of .rmtreeignore in the working and xochitl directories")
+	pflag.BoolVarP(&config.JSON, "json", "j", false, "Print the tree as JSON instead of text")
+	pflag.IntVarP(&config.Depth, "depth", "d", 0, "Only descend this many levels (0 for no limit); folders with hidden contents are marked …")
+	pflag.BoolVar(&config.SortKeys, "sort-keys", false, "Write all JSON object keys in alphabetical order")
+	pflag.StringVarP(&config.Sort, "sort", "S", config.Sort, "Order within each folder: name, natural (numbers by value), modified (newest first; ties broken by file mtime, then name, then UUID), opened (most recently opened first) or type")
+	pflag.StringVar(&config.Name, "name", "", "Label for the tablet, shown as the first line of the tree and as \"tablet\" in --json")
+	pflag.BoolVarP(&config.DirsOnly, "dirs-only", "D", false, "Only show folders")
+	pflag.BoolVar(&config.RenderReport, "render-report", false, "List the notebooks and annotated documents that need rendering to be exported")
+	pflag.StringVar(&config.Match, "match", "", "Only show items whose name matches this shell pattern, and the folders leading to them")
+	pflag.BoolVar(&config.CaseSensitive, "case-sensitive", false, "Match --match patterns case-sensitively")
+	pflag.BoolVar(&config.SafeNames, "safe-names", false, "In symlink and zip mode, limit file names to letters, digits, dot, dash and underscore")
+	pflag.BoolVarP(&config.Copy, "copy", "c", false, "Like --symlinks, but copy the files instead of linking to them")
+	pflag.BoolVar(&config.Force, "force", false, "With --copy, overwrite files that already exist in the output")
+	pflag.StringVar(&config.Tee, "tee", "", "Also write the output to this file, without colors")
+	pflag.StringVar(&config.RenderCmd, "render-cmd", "", "In symlink, copy and zip mode, render notebooks to PDF with this command ({uuid}, {src} and {dst} are replaced)")
+	pflag.BoolVar(&config.Pages, "pages", false, "Show the page count of each document")
+	pflag.BoolVar(&config.ProgressJSON, "progress-json", false, "Write progress events as JSON lines to stderr")
+	pflag.BoolVar(&config.NoEmptyDirs, "no-empty-dirs", false, "In symlink and copy mode, remove folders that end up with nothing exported in them")
+	pflag.StringVar(&config.SSH, "ssh", "", "Read the metadata from a reMarkable over SSH, e.g. root@10.11.99.1")
+	pflag.StringVar(&config.Identity, "identity", "", "Private key for --ssh (the SSH agent is used as well)")
+	pflag.BoolVar(&config.NoTrash, "no-trash", false, "Leave out the Trash")
+	pflag.BoolVar(&config.OnlyTrash, "only-trash", false, "Show only the items in the Trash")
+	pflag.StringSliceVar(&config.OrigExt, "orig-ext", nil, "Only show documents imported from files with these extensions (e.g. cbz), comma separated")
+	pflag.BoolVarP(&config.Favorites, "favorites", "f", false, "Only show pinned (favorite) documents and folders")
+	pflag.BoolVar(&config.ShowPins, "show-pins", false, "Mark pinned items with ★")
+	pflag.StringVar(&config.Exists, "exists", "", "Exit with status 0 if an item with this name exists, 1 if not (--verbose prints its path)")
+	pflag.StringVar(&config.ExistsUUID, "exists-uuid", "", "Exit with status 0 if an item with this UUID exists, 1 if not")
+	pflag.BoolVarP(&config.Markdown, "markdown", "m", false, "Print the tree as a nested Markdown list")
+	pflag.StringVar(&config.ExportSince, "export-since", "", "In symlink and copy mode, only export documents modified within this long (e.g. 36h, 7d, 2w); implies --no-empty-dirs")
+	pflag.BoolVar(&config.Orphans, "orphans", false, "List the items whose parent folder is missing and exit")
+	pflag.BoolVar(&config.TreeHash, "tree-hash", false, "Print a SHA-256 fingerprint of the folder structure and names and exit")
+	pflag.IntVar(&config.Jobs, "jobs", config.Jobs, "Number of metadata files to read at once")
+	pflag.BoolVar(&config.Records, "records", false, "Print one JSON object per item with a fixed set of fields")
+	pflag.BoolVar(&config.HTML, "html", false, "Print the tree as a standalone HTML page with collapsible folders")
+	pflag.IntVar(&config.PruneMaxDepth, "prune-max-depth", 0, "With --prune or --verify, only look this many levels below the output (0 = no limit)")
+	pflag.BoolVar(&config.AgeReport, "age-report", false, "Count documents and their size by when they were last modified and exit")
+	pflag.BoolVar(&config.Size, "size", false, "Show the size of each document and the total size of each folder")
+	pflag.StringVar(&config.NameField, "name-field", "", "In symlink mode, name documents after this .metadata field (or uuid) instead of visibleName")
+	pflag.StringVar(&config.LinkType, "link-type", config.LinkType, "How to export documents: symlink, hardlink or copy (hardlink and copy imply --symlinks)")
+	pflag.BoolVar(&config.RelativeDates, "json-relative-dates", false, "With --json, add lastModified (RFC 3339) and modifiedAgo (e.g. \"3 days ago\") to each item")
+	pflag.BoolVar(&config.DryRun, "dry-run", false, "In symlink and copy mode, print the folders and files that would be created without writing anything")
+	pflag.BoolVar(&config.TrashSummary, "trash-summary", false, "Show the Trash as one line with the number of items in it")
+	pflag.BoolVar(&config.Dedupe, "dedupe", false, "With --link-type hardlink or copy, hard link documents with identical content to one file")
+	pflag.BoolVar(&config.Stats, "stats", false, "After the tree, print the number of folders, documents of each type and trashed items")
+	pflag.BoolVarP(&config.Quiet, "quiet", "q", false, "Don't print the tree; with --stats, print only the statistics")
+	pflag.BoolVar(&config.JSONWithRender, "json-with-render", false, "Like --json, with the text tree in a \"rendered\" field")
+	pflag.BoolVar(&config.ASCII, "ascii", false, "Draw the tree with plain ASCII characters and no icons, for terminals without UTF-8")
+	pflag.BoolVar(&config.Opened, "opened", false, "Show when each document was last opened on the tablet")
+	pflag.BoolVar(&config.FlatExport, "flat-export", false, "Export all documents into the output directly, named after their folder path (implies --symlinks)")
+	pflag.StringVar(&config.FlatSep, "path-sep-in-name", config.FlatSep, "With --flat-export, the text joining folder names in file names")
+	pflag.StringVar(&config.Find, "find", "", "Print the full path of every item whose name contains this text (ignoring case)")
+	pflag.StringVar(&config.FindRegex, "find-regex", "", "Print the full path of every item whose name matches this regular expression")
+	pflag.StringVar(&config.CompareJSON, "compare-json", "", "Compare the tree with a file saved from --json and print added, removed and changed items")
+	pflag.BoolVar(&config.Created, "created", false, "Show how long ago each item was created on the tablet")
+	pflag.IntVar(&config.ExportJobs, "export-jobs", config.ExportJobs, "Number of documents to copy or link at once")
+	pflag.IntVar(&config.JSONDepth, "json-depth", 0, "Only include this many levels in --json output (0 for no limit); independent of --depth")
+	pflag.StringArrayVar(&config.Moves, "move", nil, "Move an item into a folder, given as UUID:DEST (DEST is a folder path or UUID)")
+	pflag.StringVar(&config.MoveFrom, "move-from", "", "Read UUID:DEST moves from a file, one per line")
+	pflag.StringArrayVar(&config.Mkdirs, "mkdir", nil, "Create a folder path, including missing parent folders")
+	pflag.BoolVarP(&config.Yes, "yes", "y", false, "Confirm operations that modify the reMarkable metadata")
+	printEffectiveConfig := pflag.Bool("print-config", false, "Print the effective configuration as JSON and exit")
+	pflag.Usage = usage
 	pflag.Parse()
 
+	if err := applyConfigLayers(pflag.CommandLine); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
 	if *showVersion {
 		fmt.Println("rmtree version", version)
 		os.Exit(0)
@@ -102,235 +669,1534 @@ func parseArgs() Config {
 	}
 
 	if *noColor {
+		config.Color = "never"
+	}
+	switch config.Color {
+	case "always":
+	case "never":
 		config.UseColor = false
+	case "auto":
+		config.UseColor = isTerminal(os.Stdout) && os.Getenv("NO_COLOR") == ""
+	default:
+		fmt.Fprintf(os.Stderr, "Error: unknown --color '%s' (want auto, always or never)\n", config.Color)
+		os.Exit(1)
 	}
 
-	return config
-}
+	if err := validateFields(config.Fields); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
 
-func loadItems(remarkablePath string) (map[string]*Item, error) {
-	metadataFiles, err := filepath.Glob(filepath.Join(remarkablePath, "*.metadata"))
-	if err != nil {
-		return nil, err
+	if config.RMConverter != "" && !strings.Contains(config.RMConverter, "{src}") {
+		fmt.Fprintln(os.Stderr, "Error: --rm-converter must contain {src}")
+		os.Exit(1)
 	}
 
-	items := make(map[string]*Item)
-	var mu sync.Mutex
-	var wg sync.WaitGroup
+	for _, docType := range config.Only {
+		if docType != "pdf" && docType != "epub" && docType != "notebook" {
+			fmt.Fprintf(os.Stderr, "Error: unknown document type '%s' in --only (valid types: pdf, epub, notebook)\n", docType)
+			os.Exit(1)
+		}
+	}
 
-	// Load PDF and EPUB files for type detection
-	pdfFiles, _ := filepath.Glob(filepath.Join(remarkablePath, "*.pdf"))
-	epubFiles, _ := filepath.Glob(filepath.Join(remarkablePath, "*.epub"))
+	if config.FindRegex != "" {
+		if _, err := regexp.Compile(config.FindRegex); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid --find-regex: %v\n", err)
+			os.Exit(1)
+		}
+	}
 
-	pdfMap := make(map[string]bool)
-	epubMap := make(map[string]bool)
+	if config.Filter != "" {
+		if _, err := parseFilter(config.Filter); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --filter: %v\n", err)
+			os.Exit(1)
+		}
+	}
 
-	for _, f := range pdfFiles {
-		uuid := strings.TrimSuffix(filepath.Base(f), ".pdf")
-		pdfMap[uuid] = true
+	if config.Highlight != "" {
+		pattern, err := regexp.Compile("(?i)" + config.Highlight)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --highlight: %v\n", err)
+			os.Exit(1)
+		}
+		highlightPattern = pattern
 	}
 
-	for _, f := range epubFiles {
-		uuid := strings.TrimSuffix(filepath.Base(f), ".epub")
-		epubMap[uuid] = true
+	if config.JSONWithRender {
+		config.JSON = true
 	}
 
-	// Process metadata files concurrently
-	for _, metadataFile := range metadataFiles {
-		wg.Add(1)
-		go func(file string) {
-			defer wg.Done()
+	// The icons are emoji, which ASCII terminals can't show either
+	if config.ASCII {
+		config.ShowIcons = false
+	}
 
-			uuid := strings.TrimSuffix(filepath.Base(file), ".metadata")
+	switch config.LinkType {
+	case "symlink", "hardlink":
+	case "copy":
+		config.Copy = true
+	default:
+		fmt.Fprintf(os.Stderr, "Error: unknown --link-type '%s' (want symlink, hardlink or copy)\n", config.LinkType)
+		os.Exit(1)
+	}
+	if config.Copy {
+		config.LinkType = "copy"
+	}
 
-			data, err := os.ReadFile(file)
-			if err != nil {
-				return
-			}
+	// Copying, hard linking and flat exports walk the tree exactly like symlink mode
+	if config.LinkType != "symlink" || config.FlatExport {
+		config.SymLink = true
+	}
 
-			var metadata Metadata
-			if err := json.Unmarshal(data, &metadata); err != nil {
-				return
-			}
+	if config.ExportSince != "" {
+		if !config.SymLink {
+			fmt.Fprintln(os.Stderr, "Error: --export-since needs --symlinks or --copy")
+			os.Exit(1)
+		}
+		if _, err := parseAge(config.ExportSince); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --export-since: %v\n", err)
+			os.Exit(1)
+		}
+		config.NoEmptyDirs = true
+	}
 
-			if metadata.Deleted {
-				return
-			}
+	if config.SSH != "" && (config.SymLink || config.ZipFile != "" || len(config.Moves) > 0 || config.MoveFrom != "" || len(config.Mkdirs) > 0 || config.RepairOrphans) {
+		fmt.Fprintln(os.Stderr, "Error: --ssh only supports listing; export and metadata changes need local access to the files")
+		os.Exit(1)
+	}
 
-			if metadata.VisibleName == "" {
-				metadata.VisibleName = "Unnamed"
-			}
-			if metadata.Type == "" {
-				metadata.Type = "DocumentType"
-			}
+	if config.NoTrash && config.OnlyTrash {
+		fmt.Fprintln(os.Stderr, "Error: --no-trash and --only-trash cannot be used together")
+		os.Exit(1)
+	}
 
-			item := &Item{
-				UUID:   uuid,
-				Name:   metadata.VisibleName,
-				Type:   metadata.Type,
-				Parent: metadata.Parent,
-			}
+	if config.NameField != "" && !metadataFieldName.MatchString(config.NameField) {
+		fmt.Fprintf(os.Stderr, "Error: invalid --name-field '%s' (want a .metadata field name such as visibleName or uuid)\n", config.NameField)
+		os.Exit(1)
+	}
 
-			// Determine document type
-			if metadata.Type != "CollectionType" {
-				if epubMap[uuid] {
-					item.DocType = "epub"
-				} else if pdfMap[uuid] {
-					item.DocType = "pdf"
-				} else {
-					item.DocType = "notebook"
-				}
-			}
+	if config.FlatExport && (config.FlatSep == "" || strings.ContainsRune(config.FlatSep, os.PathSeparator)) {
+		fmt.Fprintln(os.Stderr, "Error: --path-sep-in-name must not be empty or contain a path separator")
+		os.Exit(1)
+	}
 
-			// Create sort key: 0 for folders, 1 for documents, then name
-			sortPrefix := "1"
-			if metadata.Type == "CollectionType" {
-				sortPrefix = "0"
-			}
-			item.SortKey = sortPrefix + "|" + metadata.VisibleName
+	if config.Dedupe && config.LinkType == "symlink" {
+		fmt.Fprintln(os.Stderr, "Error: --dedupe needs --link-type hardlink or copy")
+		os.Exit(1)
+	}
 
-			mu.Lock()
-			items[uuid] = item
-			mu.Unlock()
-		}(metadataFile)
+	if config.PruneMaxDepth < 0 {
+		fmt.Fprintln(os.Stderr, "Error: --prune-max-depth must be 0 or more")
+		os.Exit(1)
 	}
 
-	wg.Wait()
-	return items, nil
-}
+	if config.Jobs < 1 {
+		fmt.Fprintln(os.Stderr, "Error: --jobs must be at least 1")
+		os.Exit(1)
+	}
 
-func buildChildrenMap(items map[string]*Item) map[string][]*Item {
-	children := make(map[string][]*Item)
+	if config.ExportJobs < 1 {
+		fmt.Fprintln(os.Stderr, "Error: --export-jobs must be at least 1")
+		os.Exit(1)
+	}
 
-	for _, item := range items {
-		parent := item.Parent
-		if parent == "" {
-			parent = "root"
-		}
-		children[parent] = append(children[parent], item)
+	if config.Depth < 0 {
+		fmt.Fprintln(os.Stderr, "Error: --depth must not be negative")
+		os.Exit(1)
 	}
 
-	return children
-}
+	if config.JSONDepth < 0 {
+		fmt.Fprintln(os.Stderr, "Error: --json-depth must not be negative")
+		os.Exit(1)
+	}
 
-func sortItems(items map[string]*Item, children map[string][]*Item) {
-	for parent := range children {
-		sort.Slice(children[parent], func(i, j int) bool {
-			return children[parent][i].SortKey < children[parent][j].SortKey
-		})
+	if _, err := filepath.Match(config.Match, ""); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: invalid --match pattern '%s'\n", config.Match)
+		os.Exit(1)
 	}
-}
 
-func printTree(items map[string]*Item, children map[string][]*Item, config Config) {
-	fmt.Println(".")
+	if config.WithPaths && config.Compact {
+		fmt.Fprintln(os.Stderr, "Error: --with-paths cannot be used with --compact")
+		os.Exit(1)
+	}
 
-	roots := children["root"]
-	trashItems := children["trash"]
+	switch config.Sort {
+	case "name", "natural", "modified", "opened", "type":
+	default:
+		fmt.Fprintf(os.Stderr, "Error: unknown --sort '%s' (want name, natural, modified, opened or type)\n", config.Sort)
+		os.Exit(1)
+	}
 
-	dirCount := 0
-	fileCount := 0
+	if config.FlatSort != "tree" && config.FlatSort != "path" {
+		fmt.Fprintf(os.Stderr, "Error: unknown --flat-sort '%s' (want tree or path)\n", config.FlatSort)
+		os.Exit(1)
+	}
 
-	for _, item := range items {
-		if item.Type == "CollectionType" {
-			dirCount++
-		} else {
-			fileCount++
-		}
+	if config.EOL != "lf" && config.EOL != "crlf" {
+		fmt.Fprintf(os.Stderr, "Error: unknown --eol '%s' (want lf or crlf)\n", config.EOL)
+		os.Exit(1)
 	}
 
-	// Print root items
-	for i, item := range roots {
-		isLast := i == len(roots)-1 && len(trashItems) == 0
-		printItem(item, "", isLast, 0, children, config)
+	switch config.OnCollision {
+	case "number", "uuid", "skip", "overwrite":
+	default:
+		fmt.Fprintf(os.Stderr, "Error: unknown --on-collision strategy '%s' (want number, uuid, skip or overwrite)\n", config.OnCollision)
+		os.Exit(1)
 	}
 
-	// Print trash items
-	if len(trashItems) > 0 {
-		dirCount++ // Add trash folder to count
+	if config.RenderCmd != "" && !strings.Contains(config.RenderCmd, "{dst}") {
+		fmt.Fprintln(os.Stderr, "Error: --render-cmd must contain {dst}")
+		os.Exit(1)
+	}
 
-		connector := "└── "
-		icon := ""
-		if config.ShowIcons {
-			icon = "📁 "
-		}
+	extTypes, err := parseExtMap(config.ExtMap)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	config.ExtTypes = extTypes
 
-		color := ""
-		colorReset := ""
+	ignorePatterns, err := loadIgnorePatterns(config.IgnoreFile, config.Path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: reading ignore file: %v\n", err)
+		os.Exit(1)
+	}
+	config.IgnorePatterns = ignorePatterns
+
+	if pflag.CommandLine.Changed("system-names") {
+		config.SkipSystem = true
+	}
+
+	if config.PathSep == "" {
+		fmt.Fprintln(os.Stderr, "Error: --path-sep must not be empty")
+		os.Exit(1)
+	}
+
+	if !pflag.CommandLine.Changed("escape-names") {
+		config.EscapeNames = isTerminal(os.Stdout)
+	}
+
+	// Sixel images are only useful on a terminal
+	if config.Thumbnails && !isTerminal(os.Stdout) {
+		config.Thumbnails = false
+	}
+
+	if *printEffectiveConfig {
+		if err := printConfig(config); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	return config
+}
+
+// writeBOM writes a UTF-8 byte order mark to f if it is an empty regular file.
+// Terminals, pipes and files being appended to are left alone, so the mark
+// is never shown or written twice.
+func writeBOM(f *os.File) {
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() || fi.Size() > 0 {
+		return
+	}
+	f.WriteString("\xEF\xBB\xBF")
+}
+
+// teeFile is the file opened for --tee, or nil.
+var teeFile *os.File
+
+// stdoutWriter returns the writer for listing output: stdout, with line
+// endings translated to CRLF by --eol crlf unless stdout is a terminal. With
+// --tee the output is also written to the tee file without colors.
+func stdoutWriter(config Config) io.Writer {
+	var w io.Writer = os.Stdout
+	if config.EOL == "crlf" && !isTerminal(os.Stdout) {
+		w = crlfWriter{w}
+	}
+
+	if teeFile != nil {
+		var file io.Writer = teeFile
+		if config.EOL == "crlf" {
+			file = crlfWriter{file}
+		}
+		w = io.MultiWriter(w, stripANSIWriter{file})
+	}
+	return w
+}
+
+// stripANSIWriter removes escape sequences such as colors from what is
+// written to it. Each write must hold whole sequences, as fmt calls do.
+type stripANSIWriter struct {
+	w io.Writer
+}
+
+func (s stripANSIWriter) Write(p []byte) (int, error) {
+	if _, err := s.w.Write(ansiEscape.ReplaceAll(p, nil)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// crlfWriter replaces each "\n" written to it with "\r\n".
+type crlfWriter struct {
+	w io.Writer
+}
+
+func (c crlfWriter) Write(p []byte) (int, error) {
+	if _, err := c.w.Write(bytes.ReplaceAll(p, []byte("\n"), []byte("\r\n"))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// isTerminal reports whether f is attached to a terminal.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// loadItems reads the items from the .metadata files in the xochitl directory
+// fsys, reading up to jobs files at once. If cache is not nil, files unchanged
+// since it was saved are not parsed again.
+func loadItems(fsys fs.FS, extTypes map[string]string, cache *MetadataCache, jobs int) (map[string]*Item, error) {
+	metadataFiles, err := fs.Glob(fsys, "*.metadata")
+	if err != nil {
+		return nil, err
+	}
+
+	items := make(map[string]*Item)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	// Load backing files for type detection: EPUB first, then PDF, then --ext-map extensions
+	backing := make(map[string]string)
+	extensions := []string{"epub", "pdf"}
+	for ext := range extTypes {
+		extensions = append(extensions, ext)
+	}
+	sort.Strings(extensions[2:])
+
+	for _, ext := range extensions {
+		files, _ := fs.Glob(fsys, "*."+ext)
+		for _, f := range files {
+			uuid := strings.TrimSuffix(filepath.Base(f), "."+ext)
+			if _, ok := backing[uuid]; !ok {
+				backing[uuid] = ext
+			}
+		}
+	}
+
+	// Process metadata files concurrently, jobs at a time
+	sem := make(chan struct{}, jobs)
+	progress.start("load", len(metadataFiles))
+	for _, metadataFile := range metadataFiles {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(file string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			defer progress.step()
+
+			uuid := strings.TrimSuffix(filepath.Base(file), ".metadata")
+
+			metadata, err := readMetadata(fsys, file, cache)
+			if err != nil {
+				warnf("Warning: skipping '%s': %v\n", file, err)
+				return
+			}
+
+			if metadata.Deleted {
+				return
+			}
+
+			if metadata.VisibleName == "" {
+				metadata.VisibleName = "Unnamed"
+			}
+			if metadata.Type == "" {
+				metadata.Type = "DocumentType"
+			}
+
+			item := &Item{
+				UUID:         uuid,
+				Name:         metadata.VisibleName,
+				Type:         metadata.Type,
+				Parent:       metadata.Parent,
+				LastModified: metadata.LastModified.Time,
+				Pinned:       metadata.Pinned,
+				LastOpened:   metadata.LastOpened.Time,
+				Created:      metadata.CreatedTime.Time,
+			}
+
+			// Determine document type
+			if metadata.Type != "CollectionType" {
+				if ext, ok := backing[uuid]; ok {
+					item.Ext = ext
+					item.DocType = ext
+					if docType, ok := extTypes[ext]; ok {
+						item.DocType = docType
+					}
+				} else {
+					item.DocType = "notebook"
+				}
+			}
+
+			// Create sort key: 0 for folders, 1 for documents, then name
+			sortPrefix := "1"
+			if metadata.Type == "CollectionType" {
+				sortPrefix = "0"
+			}
+			item.SortKey = sortPrefix + "|" + metadata.VisibleName
+
+			mu.Lock()
+			items[uuid] = item
+			mu.Unlock()
+		}(metadataFile)
+	}
+
+	wg.Wait()
+	return items, nil
+}
+
+// readMetadata parses a .metadata file, or takes it from cache if the file
+// hasn't changed.
+func readMetadata(fsys fs.FS, file string, cache *MetadataCache) (Metadata, error) {
+	var metadata Metadata
+
+	var fi fs.FileInfo
+	if cache != nil {
+		var err error
+		if fi, err = fs.Stat(fsys, file); err != nil {
+			return metadata, err
+		}
+		if cached, ok := cache.lookup(file, fi); ok {
+			return cached, nil
+		}
+	}
+
+	data, err := fs.ReadFile(fsys, file)
+	if err != nil {
+		return metadata, err
+	}
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return metadata, err
+	}
+
+	if cache != nil {
+		cache.store(file, fi, metadata)
+	}
+	return metadata, nil
+}
+
+// xochitlFS is the xochitl directory opened by run, on the local disk or over
+// --ssh.
+var xochitlFS fs.FS
+
+// sourceFS returns the filesystem to read the files of the xochitl directory
+// at remarkablePath from: the one opened by run, or the local directory.
+func sourceFS(remarkablePath string) fs.FS {
+	if xochitlFS != nil {
+		return xochitlFS
+	}
+	return os.DirFS(remarkablePath)
+}
+
+// backingFile returns the path of the PDF, EPUB or --ext-map file behind a
+// document, or an empty string for notebooks and folders.
+func backingFile(item *Item, remarkablePath string) string {
+	if item.Ext == "" {
+		return ""
+	}
+	return filepath.Join(remarkablePath, item.UUID+"."+item.Ext)
+}
+
+// parseExtMap parses --ext-map pairs such as "cbz=pdf:mobi=epub" into a map
+// from file extension to document type.
+func parseExtMap(value string) (map[string]string, error) {
+	extTypes := make(map[string]string)
+	if value == "" {
+		return extTypes, nil
+	}
+
+	for _, pair := range strings.Split(value, ":") {
+		ext, docType, ok := strings.Cut(pair, "=")
+		ext = strings.TrimPrefix(strings.ToLower(ext), ".")
+		if !ok || ext == "" || strings.ContainsAny(ext, "*?[/") {
+			return nil, fmt.Errorf("invalid --ext-map entry '%s', expected EXT=TYPE", pair)
+		}
+		if docType != "pdf" && docType != "epub" {
+			return nil, fmt.Errorf("unknown document type '%s' in --ext-map (valid types: pdf, epub)", docType)
+		}
+		extTypes[ext] = docType
+	}
+	return extTypes, nil
+}
+
+// detectLocked marks documents whose backing file is encrypted or can't be read.
+func detectLocked(items map[string]*Item, remarkablePath string) {
+	fsys := sourceFS(remarkablePath)
+	for _, item := range items {
+		if item.Ext != "" {
+			item.Locked = isLocked(fsys, item.UUID+"."+item.Ext, item.Ext)
+		}
+	}
+}
+
+// loadPageCounts reads the page count of each document from its .content
+// file. Documents whose .content file is missing or broken keep a count of 0.
+func loadPageCounts(items map[string]*Item, remarkablePath string) {
+	for _, item := range items {
+		if item.Type == "CollectionType" {
+			continue
+		}
+		if content, err := readContent(remarkablePath, item.UUID); err == nil {
+			item.PageCount = max(content.PageCount, len(content.pageIDs()))
+		}
+	}
+}
+
+// loadSizes sets the size of each document from its files, and of each
+// folder to the total of the documents below it.
+func loadSizes(items map[string]*Item, remarkablePath string) {
+	for _, item := range items {
+		if item.Type == "CollectionType" {
+			continue
+		}
+		item.Size = documentSize(item, remarkablePath)
+
+		parent, ok := items[item.Parent]
+		for depth := 0; ok && depth < 50; depth++ {
+			parent.Size += item.Size
+			parent, ok = items[parent.Parent]
+		}
+	}
+}
+
+// detectEmpty marks documents whose backing file is zero bytes, as left by
+// cloud-only or failed downloads.
+func detectEmpty(items map[string]*Item, remarkablePath string) {
+	fsys := sourceFS(remarkablePath)
+	for _, item := range items {
+		if item.Ext != "" {
+			if fi, err := fs.Stat(fsys, item.UUID+"."+item.Ext); err == nil && fi.Size() == 0 {
+				item.Empty = true
+			}
+		}
+	}
+}
+
+func isLocked(fsys fs.FS, name, ext string) bool {
+	file, err := fsys.Open(name)
+	if err != nil {
+		return true
+	}
+	defer file.Close()
+
+	fi, err := file.Stat()
+	if err != nil {
+		return true
+	}
+	f, ok := file.(io.ReaderAt)
+	if !ok {
+		return false
+	}
+
+	switch ext {
+	case "pdf":
+		// Encrypted PDFs reference an /Encrypt dictionary from the trailer at the end of the file
+		buf := make([]byte, 4096)
+		n, _ := f.ReadAt(buf, max(fi.Size()-int64(len(buf)), 0))
+		return bytes.Contains(buf[:n], []byte("/Encrypt"))
+	case "epub":
+		// DRM-protected EPUBs carry a rights file next to the container
+		zr, err := zip.NewReader(f, fi.Size())
+		if err != nil {
+			return false
+		}
+		for _, zf := range zr.File {
+			if zf.Name == "META-INF/rights.xml" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// applyFilters narrows items down to the documents selected by the filter
+// options, keeping the folders that lead to them.
+func applyFilters(items map[string]*Item, config Config) (map[string]*Item, error) {
+	if config.NewerThan != "" {
+		fi, err := os.Stat(config.NewerThan)
+		if err != nil {
+			return nil, fmt.Errorf("reading --newer-than reference file: %w", err)
+		}
+		cutoff := fi.ModTime()
+		items = filterItems(items, func(item *Item) bool {
+			return item.LastModified.After(cutoff)
+		})
+	}
+
+	if config.NoTrash || config.OnlyTrash {
+		kept := make(map[string]*Item)
+		for uuid, item := range items {
+			if (topAncestor(item, items).Parent == "trash") == config.OnlyTrash {
+				kept[uuid] = item
+			}
+		}
+		items = kept
+	}
+
+	if config.Favorites {
+		items = filterWithAncestors(items, func(item *Item) bool {
+			return item.Pinned
+		})
+	}
+
+	if config.DirsOnly {
+		folders := make(map[string]*Item)
+		for uuid, item := range items {
+			if item.Type == "CollectionType" {
+				folders[uuid] = item
+			}
+		}
+		items = folders
+	}
+
+	if len(config.IgnorePatterns) > 0 {
+		items = excludeIgnored(items, config.IgnorePatterns)
+	}
+
+	if config.Match != "" {
+		pattern := config.Match
+		if !config.CaseSensitive {
+			pattern = strings.ToLower(pattern)
+		}
+		items = filterWithAncestors(items, func(item *Item) bool {
+			name := item.Name
+			if !config.CaseSensitive {
+				name = strings.ToLower(name)
+			}
+			ok, _ := filepath.Match(pattern, name)
+			return ok
+		})
+	}
+
+	if len(config.Only) > 0 {
+		items = filterItems(items, func(item *Item) bool {
+			return slices.Contains(config.Only, item.DocType)
+		})
+	}
+
+	if len(config.OrigExt) > 0 {
+		items = filterItems(items, func(item *Item) bool {
+			if item.DocType == "notebook" {
+				return false
+			}
+			ext := originalExtension(item, config.Path)
+			return slices.ContainsFunc(config.OrigExt, func(want string) bool {
+				return strings.EqualFold(strings.TrimPrefix(want, "."), ext)
+			})
+		})
+	}
+
+	if config.Filter != "" {
+		expr, err := parseFilter(config.Filter)
+		if err != nil {
+			return nil, fmt.Errorf("--filter: %w", err)
+		}
+		items = filterItems(items, func(item *Item) bool {
+			return expr.eval(&filterItem{Item: item, remarkablePath: config.Path})
+		})
+	}
+
+	if config.SkipSystem {
+		items = excludeTopLevel(items, func(item *Item) bool {
+			for _, name := range config.SystemNames {
+				if item.UUID == name || strings.EqualFold(item.Name, name) {
+					return true
+				}
+			}
+			return false
+		})
+	}
+
+	return items, nil
+}
+
+// defaultSystemNames are the top-level items created by the reMarkable itself.
+var defaultSystemNames = []string{"Quick sheets", "My files", "templates"}
+
+// excludeTopLevel drops the top-level items for which exclude returns true,
+// along with everything inside them.
+func excludeTopLevel(items map[string]*Item, exclude func(*Item) bool) map[string]*Item {
+	kept := make(map[string]*Item)
+
+	for uuid, item := range items {
+		top := topAncestor(item, items)
+		if top.Parent == "" && exclude(top) {
+			continue
+		}
+		kept[uuid] = item
+	}
+
+	return kept
+}
+
+// filterItems returns the documents for which keep returns true, together
+// with their ancestor folders.
+func filterItems(items map[string]*Item, keep func(*Item) bool) map[string]*Item {
+	return filterWithAncestors(items, func(item *Item) bool {
+		return item.Type != "CollectionType" && keep(item)
+	})
+}
+
+// filterWithAncestors returns the documents and folders for which keep returns
+// true, together with their ancestor folders.
+func filterWithAncestors(items map[string]*Item, keep func(*Item) bool) map[string]*Item {
+	filtered := make(map[string]*Item)
+
+	for uuid, item := range items {
+		if !keep(item) {
+			continue
+		}
+		filtered[uuid] = item
+
+		parent := item.Parent
+		for depth := 0; depth < 50; depth++ {
+			p, ok := items[parent]
+			if !ok {
+				break
+			}
+			filtered[parent] = p
+			parent = p.Parent
+		}
+	}
+
+	return filtered
+}
+
+func buildChildrenMap(items map[string]*Item) map[string][]*Item {
+	children := make(map[string][]*Item)
+
+	for _, item := range items {
+		parent := item.Parent
+		if parent == "" {
+			parent = "root"
+		}
+		children[parent] = append(children[parent], item)
+	}
+
+	return children
+}
+
+// sortItems orders each folder's children. The SortKey prefix before the
+// name (folders before documents, and pinned items first with --pinned-first)
+// always applies; within it items are sorted by name, by last modified
+// (newest first) or by document type and then name. Items sorted by last
+// modified that share a timestamp are ordered by the modification time of
+// their files (newest first), then by name and finally by UUID.
+func sortItems(items map[string]*Item, children map[string][]*Item, config Config) {
+	fileTimes := make(map[*Item]time.Time)
+	fileTime := func(item *Item) time.Time {
+		t, ok := fileTimes[item]
+		if !ok {
+			t = fileModTime(item, config.Path)
+			fileTimes[item] = t
+		}
+		return t
+	}
+
+	for parent := range children {
+		sort.Slice(children[parent], func(i, j int) bool {
+			a, b := children[parent][i], children[parent][j]
+			groupA := a.SortKey[:len(a.SortKey)-len(a.Name)]
+			groupB := b.SortKey[:len(b.SortKey)-len(b.Name)]
+			if groupA != groupB {
+				return groupA < groupB
+			}
+
+			switch config.Sort {
+			case "modified":
+				if !a.LastModified.Equal(b.LastModified) {
+					return a.LastModified.After(b.LastModified)
+				}
+				if timeA, timeB := fileTime(a), fileTime(b); !timeA.Equal(timeB) {
+					return timeA.After(timeB)
+				}
+			case "type":
+				if a.DocType != b.DocType {
+					return a.DocType < b.DocType
+				}
+			case "opened":
+				if !a.LastOpened.Equal(b.LastOpened) {
+					return a.LastOpened.After(b.LastOpened)
+				}
+			case "natural":
+				if c := naturalCompare(a.Name, b.Name); c != 0 {
+					return c < 0
+				}
+			}
+
+			if a.SortKey != b.SortKey {
+				return a.SortKey < b.SortKey
+			}
+			return a.UUID < b.UUID
+		})
+	}
+}
+
+// naturalCompare compares two names like strings.Compare, except that runs of
+// digits are compared by their numeric value, so "doc2" sorts before "doc10".
+func naturalCompare(a, b string) int {
+	for a != "" && b != "" {
+		if isDigit(a[0]) && isDigit(b[0]) {
+			numA, restA := splitDigits(a)
+			numB, restB := splitDigits(b)
+			if c := cmp.Compare(len(numA), len(numB)); c != 0 {
+				return c
+			}
+			if c := strings.Compare(numA, numB); c != 0 {
+				return c
+			}
+			a, b = restA, restB
+			continue
+		}
+		if a[0] != b[0] {
+			return cmp.Compare(a[0], b[0])
+		}
+		a, b = a[1:], b[1:]
+	}
+	return cmp.Compare(len(a), len(b))
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// splitDigits splits the leading digits off s, dropping leading zeros from
+// the number.
+func splitDigits(s string) (number, rest string) {
+	end := 0
+	for end < len(s) && isDigit(s[end]) {
+		end++
+	}
+	return strings.TrimLeft(s[:end], "0"), s[end:]
+}
+
+// fileModTime returns the modification time of a document's backing file, or
+// of its .content file for notebooks and folders, as a tiebreak for items
+// with the same lastModified.
+func fileModTime(item *Item, remarkablePath string) time.Time {
+	name := item.UUID + ".content"
+	if item.Ext != "" {
+		name = item.UUID + "." + item.Ext
+	}
+	fi, err := fs.Stat(sourceFS(remarkablePath), name)
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
+
+// pinnedFirst adds a pinned component to the sort keys, after the folder or
+// document group and before the name, so pinned items sort first.
+func pinnedFirst(items map[string]*Item) {
+	for _, item := range items {
+		group, name, _ := strings.Cut(item.SortKey, "|")
+		pin := "1"
+		if item.Pinned {
+			pin = "0"
+		}
+		item.SortKey = group + "|" + pin + "|" + name
+	}
+}
+
+// pathNames returns the names of an item's folders from the top of its tree, ending with the item itself.
+func pathNames(item *Item, items map[string]*Item) []string {
+	names := []string{item.Name}
+	parent := item.Parent
+	for depth := 0; depth < 50; depth++ {
+		p, ok := items[parent]
+		if !ok {
+			break
+		}
+		names = append([]string{p.Name}, names...)
+		parent = p.Parent
+	}
+	return names
+}
+
+// itemPath returns the slash-delimited path of an item from the top of its tree.
+func itemPath(item *Item, items map[string]*Item) string {
+	return strings.Join(pathNames(item, items), "/")
+}
+
+// ancestorNames returns the path names of an item including the synthetic
+// Trash or Orphaned folder its tree hangs from, if any.
+func ancestorNames(item *Item, items map[string]*Item) []string {
+	names := pathNames(item, items)
+
+	switch topAncestor(item, items).Parent {
+	case "", "root":
+		return names
+	case "trash":
+		return append([]string{"Trash"}, names...)
+	default:
+		return append([]string{"Orphaned"}, names...)
+	}
+}
+
+// topAncestor returns the outermost folder containing item, or item itself if
+// it is at the top level. Its Parent tells whether the tree hangs from the
+// root, the trash or a missing folder.
+func topAncestor(item *Item, items map[string]*Item) *Item {
+	top := item
+	for depth := 0; depth < 50; depth++ {
+		p, ok := items[top.Parent]
+		if !ok {
+			break
+		}
+		top = p
+	}
+	return top
+}
+
+// ancestorPath returns the slash-delimited path of an item including the
+// synthetic Trash or Orphaned folder.
+func ancestorPath(item *Item, items map[string]*Item) string {
+	return strings.Join(ancestorNames(item, items), "/")
+}
+
+// warnedSeparators remembers names already reported as containing the --path-sep separator.
+var warnedSeparators = make(map[string]bool)
+
+// formatPath joins path names with the --path-sep separator for display.
+// A separator inside a name is escaped with a backslash so the path stays unambiguous,
+// and with --escape-names control characters and ANSI codes are escaped as in the tree.
+func formatPath(names []string, config Config) string {
+	escaped := make([]string, len(names))
+	for i, name := range names {
+		if config.EscapeNames {
+			name = escapeName(name)
+		}
+		if strings.Contains(name, config.PathSep) {
+			if !warnedSeparators[name] {
+				warnedSeparators[name] = true
+				warnf("Warning: name '%s' contains the path separator '%s'\n", name, config.PathSep)
+			}
+			name = strings.ReplaceAll(name, config.PathSep, "\\"+config.PathSep)
+		}
+		escaped[i] = name
+	}
+	return strings.Join(escaped, config.PathSep)
+}
+
+// countTree counts the folders and documents below parent.
+func countTree(parent string, children map[string][]*Item, depth int) (dirCount, fileCount int) {
+	if depth > 50 {
+		return
+	}
+	for _, child := range children[parent] {
+		if child.Type == "CollectionType" {
+			dirCount++
+		} else {
+			fileCount++
+		}
+		dirs, files := countTree(child.UUID, children, depth+1)
+		dirCount += dirs
+		fileCount += files
+	}
+	return
+}
+
+// resolveFolder finds a folder by UUID or by its slash-delimited path from root.
+// An empty path or "/" resolves to root, which is returned as nil.
+func resolveFolder(ref string, items map[string]*Item, children map[string][]*Item) (*Item, error) {
+	if item, ok := items[ref]; ok {
+		if item.Type != "CollectionType" {
+			return nil, fmt.Errorf("'%s' is not a folder", item.Name)
+		}
+		return item, nil
+	}
+
+	var folder *Item
+	parent := "root"
+	for _, name := range strings.Split(strings.Trim(ref, "/"), "/") {
+		if name == "" {
+			continue
+		}
+		var match *Item
+		for _, child := range children[parent] {
+			if child.Type != "CollectionType" || child.Name != name {
+				continue
+			}
+			if match != nil {
+				return nil, fmt.Errorf("folder path '%s' is ambiguous", ref)
+			}
+			match = child
+		}
+		if match == nil {
+			return nil, fmt.Errorf("folder '%s' not found", ref)
+		}
+		folder = match
+		parent = match.UUID
+	}
+	return folder, nil
+}
+
+// topLevel returns the items to list at the top of the tree and in the Trash.
+func topLevel(children map[string][]*Item, config Config) (roots, trashItems []*Item) {
+	if config.Root != "" {
+		return children[config.Root], nil
+	}
+	return children["root"], children["trash"]
+}
+
+// treeCounts counts the folders and documents in the tree, or below --root.
+func treeCounts(items map[string]*Item, children map[string][]*Item, config Config) (dirCount, fileCount int) {
+	if config.Root != "" {
+		return countTree(config.Root, children, 0)
+	}
+	for _, item := range items {
+		if item.Type == "CollectionType" {
+			dirCount++
+		} else {
+			fileCount++
+		}
+	}
+	return
+}
+
+func printTree(w io.Writer, items map[string]*Item, children map[string][]*Item, config Config) {
+	body := w
+	var numbered bytes.Buffer
+	if config.Numbers {
+		body = &numbered
+	}
+
+	var dirCount, fileCount int
+	if config.Compact {
+		dirCount, fileCount = renderCompactTree(body, items, children, config)
+	} else {
+		dirCount, fileCount = renderTree(body, items, children, config)
+	}
+
+	if config.Numbers {
+		writeNumbered(w, numbered.String())
+	}
+
+	fmt.Fprintln(summaryOutput(config))
+
+	summary := formatSummary(dirCount, fileCount, onlyTypeCounts(items, children, config), config)
+	if config.Size {
+		summary += ", " + formatSize(treeSize(items, config)) + " total"
+	}
+	fmt.Fprintln(summaryOutput(config), summary)
+}
+
+// treeSize returns the size of the documents in the tree, or below --root.
+func treeSize(items map[string]*Item, config Config) int64 {
+	if root, ok := items[config.Root]; ok {
+		return root.Size
+	}
+
+	var size int64
+	for _, item := range items {
+		if item.Type != "CollectionType" {
+			size += item.Size
+		}
+	}
+	return size
+}
+
+// writeNumbered writes the rendered tree with each item line prefixed by its
+// right-aligned line number. The header line is padded but not numbered.
+func writeNumbered(w io.Writer, tree string) {
+	lines := strings.Split(strings.TrimSuffix(tree, "\n"), "\n")
+	width := len(strconv.Itoa(len(lines) - 1))
+
+	for i, line := range lines {
+		if i == 0 {
+			fmt.Fprintf(w, "%*s  %s\n", width, "", line)
+		} else {
+			fmt.Fprintf(w, "%*d  %s\n", width, i, line)
+		}
+	}
+}
+
+// treeHeader returns the first line of the tree.
+func treeHeader(items map[string]*Item, config Config) string {
+	if config.ShowParents && config.Root != "" {
+		return formatPath(ancestorNames(items[config.Root], items), config)
+	}
+	if config.Name != "" {
+		return config.Name
+	}
+	return "."
+}
+
+// renderTree writes the tree and returns the folder and document counts for the summary.
+func renderTree(w io.Writer, items map[string]*Item, children map[string][]*Item, config Config) (dirCount, fileCount int) {
+	header := treeHeader(items, config)
+	if config.WithPaths {
+		header += "\t" + header
+	}
+	fmt.Fprintln(w, header)
+
+	roots, trashItems := topLevel(children, config)
+	dirCount, fileCount = treeCounts(items, children, config)
+
+	if config.GroupByType {
+		children = groupByType(children)
+		roots = children["root"]
+		if config.Root != "" {
+			roots = children[config.Root]
+		}
+	}
+
+	// Print root items
+	for i, item := range roots {
+		isLast := i == len(roots)-1 && len(trashItems) == 0
+		printItem(w, item, "", isLast, 0, items, children, config)
+	}
+
+	// Print trash items
+	if len(trashItems) > 0 {
+		dirCount++ // Add trash folder to count
+
+		connector := treeChars(config).last
+		icon := ""
+		if config.ShowIcons {
+			icon = "📁 "
+		}
+
+		color := ""
+		colorReset := ""
 		if config.UseColor {
 			color = colors["folder"]
 			colorReset = colors["reset"]
 		}
 
-		fmt.Printf("%s%s%sTrash%s\n", connector, color, icon, colorReset)
+		trashPath := ""
+		if config.WithPaths {
+			trashPath = "\tTrash"
+		}
+
+		if config.TrashSummary {
+			dirs, files := countTree("trash", children, 0)
+			itemText := "items"
+			if dirs+files == 1 {
+				itemText = "item"
+			}
+			fmt.Fprintf(w, "%s%s%sTrash%s (%d %s)%s\n", connector, color, icon, colorReset, dirs+files, itemText, trashPath)
+			return
+		}
+
+		// The trash is a top-level folder, so its items are hidden by --depth 1
+		if config.Depth == 1 {
+			fmt.Fprintf(w, "%s%s%sTrash%s %s%s\n", connector, color, icon, colorReset, treeChars(config).more, trashPath)
+			return
+		}
+
+		fmt.Fprintf(w, "%s%s%sTrash%s%s\n", connector, color, icon, colorReset, trashPath)
 
 		for i, item := range trashItems {
 			isLast := i == len(trashItems)-1
-			printTrashItem(item, "    ", isLast, 1, config)
+			printTrashItem(w, item, treeChars(config).space, isLast, 1, items, config)
+		}
+	}
+
+	return
+}
+
+// renderCompactTree writes only folders, each followed by the documents
+// directly inside it on the same line.
+func renderCompactTree(w io.Writer, items map[string]*Item, children map[string][]*Item, config Config) (dirCount, fileCount int) {
+	roots, trashItems := topLevel(children, config)
+	dirCount, fileCount = treeCounts(items, children, config)
+
+	fmt.Fprintf(w, "%s%s\n", treeHeader(items, config), inlineDocuments(roots, config))
+
+	folders := onlyFolders(roots)
+	for i, item := range folders {
+		isLast := i == len(folders)-1 && len(trashItems) == 0
+		printCompactItem(w, item, "", isLast, 0, children, config)
+	}
+
+	if len(trashItems) > 0 {
+		dirCount++ // Add trash folder to count
+		trash := &Item{UUID: "trash", Name: "Trash", Type: "CollectionType"}
+		printCompactItem(w, trash, "", true, 0, children, config)
+	}
+
+	return
+}
+
+func printCompactItem(w io.Writer, item *Item, prefix string, isLast bool, depth int, children map[string][]*Item, config Config) {
+	if depth > 50 {
+		return
+	}
+
+	chars := treeChars(config)
+	connector := chars.branch
+	if isLast {
+		connector = chars.last
+	}
+
+	icon, color, before, after := getItemFormatting(item, config)
+	itemChildren := children[item.UUID]
+
+	fmt.Fprintf(w, "%s%s%s%s%s%s/%s%s%s\n", prefix, connector, color, icon, before, displayName(item, config), resetColor(config), after, inlineDocuments(itemChildren, config))
+
+	folders := onlyFolders(itemChildren)
+	for i, child := range folders {
+		newPrefix := prefix
+		if isLast {
+			newPrefix += chars.space
+		} else {
+			newPrefix += chars.pipe
+		}
+
+		printCompactItem(w, child, newPrefix, i == len(folders)-1, depth+1, children, config)
+	}
+}
+
+// inlineDocuments returns the " : a, b, c" suffix listing the documents among
+// items, cut off with "..." after --compact-max names.
+func inlineDocuments(items []*Item, config Config) string {
+	var names []string
+	for _, item := range items {
+		if item.Type == "CollectionType" {
+			continue
+		}
+		if config.CompactMax > 0 && len(names) == config.CompactMax {
+			names = append(names, "...")
+			break
+		}
+		names = append(names, displayName(item, config))
+	}
+
+	if len(names) == 0 {
+		return ""
+	}
+	return " : " + strings.Join(names, ", ")
+}
+
+func onlyFolders(items []*Item) []*Item {
+	var folders []*Item
+	for _, item := range items {
+		if item.Type == "CollectionType" {
+			folders = append(folders, item)
+		}
+	}
+	return folders
+}
+
+// typeGroups are the headings used by --group-by-type, in display order.
+var typeGroups = []struct {
+	docType string
+	name    string
+}{
+	{"pdf", "[PDF]"},
+	{"epub", "[EPUB]"},
+	{"notebook", "[Notebooks]"},
+}
+
+// groupByType returns a copy of children where the documents of each folder
+// are moved under synthetic heading folders per document type. Folders stay
+// first and empty groups are left out. The trash listing is left as is.
+func groupByType(children map[string][]*Item) map[string][]*Item {
+	grouped := make(map[string][]*Item, len(children))
+
+	for parent, items := range children {
+		if parent == "trash" {
+			grouped[parent] = items
+			continue
+		}
+
+		byType := make(map[string][]*Item)
+		for _, item := range items {
+			if item.Type == "CollectionType" {
+				grouped[parent] = append(grouped[parent], item)
+			} else {
+				byType[item.DocType] = append(byType[item.DocType], item)
+			}
+		}
+
+		for _, group := range typeGroups {
+			if len(byType[group.docType]) == 0 {
+				continue
+			}
+			heading := &Item{
+				UUID:   parent + "/" + group.name,
+				Name:   group.name,
+				Type:   "CollectionType",
+				Parent: parent,
+			}
+			grouped[parent] = append(grouped[parent], heading)
+			grouped[heading.UUID] = byType[group.docType]
 		}
 	}
 
-	fmt.Println()
+	return grouped
+}
+
+// warnings counts the problems reported during the run, for --strict.
+var warnings atomic.Int64
+
+// warnf reports a problem that doesn't stop the run on stderr.
+func warnf(format string, args ...any) {
+	warnings.Add(1)
+	fmt.Fprintf(os.Stderr, format, args...)
+}
+
+// summaryOutput returns the stream the summary is written to: stderr, so it
+// stays out of piped output, unless --summary-stdout is set.
+func summaryOutput(config Config) io.Writer {
+	if config.SummaryStdout {
+		return stdoutWriter(config)
+	}
+	return os.Stderr
+}
+
+func printSummary(dirCount, fileCount int, typeCounts map[string]int, config Config) {
+	fmt.Fprintln(summaryOutput(config), formatSummary(dirCount, fileCount, typeCounts, config))
+}
+
+// formatSummary returns the summary line. With --only, typeCounts holds the
+// number of documents of each selected type and folders aren't mentioned, as
+// they are only shown to lead to the documents.
+func formatSummary(dirCount, fileCount int, typeCounts map[string]int, config Config) string {
+	if typeCounts != nil {
+		var counts []string
+		for _, docType := range config.Only {
+			counts = append(counts, fmt.Sprintf("%d %s", typeCounts[docType], docType))
+		}
+		return strings.Join(counts, ", ")
+	}
 
-	// Print summary
 	dirText := "directories"
 	if dirCount == 1 {
 		dirText = "directory"
 	}
 
+	if config.DirsOnly {
+		return fmt.Sprintf("%d %s", dirCount, dirText)
+	}
+
 	fileText := "files"
 	if fileCount == 1 {
 		fileText = "file"
 	}
 
-	fmt.Printf("%d %s, %d %s\n", dirCount, dirText, fileCount, fileText)
+	return fmt.Sprintf("%d %s, %d %s", dirCount, dirText, fileCount, fileText)
+}
+
+// onlyTypeCounts counts the documents in the tree, or below --root, by type
+// for the --only summary. It returns nil without --only.
+func onlyTypeCounts(items map[string]*Item, children map[string][]*Item, config Config) map[string]int {
+	if len(config.Only) == 0 {
+		return nil
+	}
+
+	counts := make(map[string]int)
+	if config.Root == "" {
+		for _, item := range items {
+			if item.Type != "CollectionType" {
+				counts[item.DocType]++
+			}
+		}
+		return counts
+	}
+
+	var walk func(parent string, depth int)
+	walk = func(parent string, depth int) {
+		if depth > 50 {
+			return
+		}
+		for _, child := range children[parent] {
+			if child.Type != "CollectionType" {
+				counts[child.DocType]++
+			}
+			walk(child.UUID, depth+1)
+		}
+	}
+	walk(config.Root, 0)
+	return counts
+}
+
+// resetColor returns the sequence ending an item's color, or nothing without
+// colors.
+func resetColor(config Config) string {
+	if !config.UseColor {
+		return ""
+	}
+	return colors["reset"]
+}
+
+// treeStyle holds the strings the tree is drawn with.
+type treeStyle struct {
+	branch string // connector of an item with more items below it
+	last   string // connector of the last item in a folder
+	pipe   string // indent below an item with more items below it
+	space  string // indent below the last item
+	more   string // follows folders whose contents are hidden by --depth
+}
+
+var (
+	unicodeTree = treeStyle{branch: "├── ", last: "└── ", pipe: "│   ", space: "    ", more: "…"}
+	asciiTree   = treeStyle{branch: "|-- ", last: "`-- ", pipe: "|   ", space: "    ", more: "..."}
+)
+
+// treeChars returns the box-drawing characters, or plain ASCII with --ascii.
+func treeChars(config Config) treeStyle {
+	if config.ASCII {
+		return asciiTree
+	}
+	return unicodeTree
+}
+
+func printItem(w io.Writer, item *Item, prefix string, isLast bool, depth int, items map[string]*Item, children map[string][]*Item, config Config) {
+	if depth > 50 {
+		return
+	}
+
+	chars := treeChars(config)
+	connector := chars.branch
+	if isLast {
+		connector = chars.last
+	}
+
+	icon, color, before, after := getItemFormatting(item, config)
+
+	itemChildren := children[item.UUID]
+	if config.Depth > 0 && depth+1 >= config.Depth && len(itemChildren) > 0 {
+		after += " " + chars.more
+		itemChildren = nil
+	}
+
+	fmt.Fprintf(w, "%s%s%s%s%s%s%s%s%s\n", prefix, connector, color, icon, before, displayName(item, config), resetColor(config), after, pathColumn(item, items, config))
+
+	if config.Thumbnails && item.Type != "CollectionType" {
+		printThumbnail(w, item, prefix, isLast, config)
+	}
+
+	// Print children
+	for i, child := range itemChildren {
+		childIsLast := i == len(itemChildren)-1
+
+		newPrefix := prefix
+		if isLast {
+			newPrefix += chars.space
+		} else {
+			newPrefix += chars.pipe
+		}
+
+		printItem(w, child, newPrefix, childIsLast, depth+1, items, children, config)
+	}
+}
+
+func printTrashItem(w io.Writer, item *Item, prefix string, isLast bool, depth int, items map[string]*Item, config Config) {
+	if depth > 50 {
+		return
+	}
+
+	chars := treeChars(config)
+	connector := chars.branch
+	if isLast {
+		connector = chars.last
+	}
+
+	icon, color, before, after := getItemFormatting(item, config)
+
+	fmt.Fprintf(w, "%s%s%s%s%s%s%s%s%s\n", prefix, connector, color, icon, before, displayName(item, config), resetColor(config), after, pathColumn(item, items, config))
+
+	if config.Thumbnails {
+		printThumbnail(w, item, prefix, isLast, config)
+	}
+}
+
+// pathColumn returns the tab and full path that --with-paths appends to a
+// tree line, or an empty string without it. Type group headings take the path
+// of the folder they are in.
+func pathColumn(item *Item, items map[string]*Item, config Config) string {
+	if !config.WithPaths {
+		return ""
+	}
+	if _, ok := items[item.UUID]; !ok {
+		parent, ok := items[item.Parent]
+		if !ok {
+			return "\t."
+		}
+		item = parent
+	}
+	return "\t" + formatPath(ancestorNames(item, items), config)
 }
 
-func printItem(item *Item, prefix string, isLast bool, depth int, children map[string][]*Item, config Config) {
-	if depth > 50 {
+// printThumbnail prints a document's cover as a sixel image below its line,
+// indented to line up with the name.
+func printThumbnail(w io.Writer, item *Item, prefix string, isLast bool, config Config) {
+	sixel := thumbnailSixel(item, config.Path)
+	if sixel == "" {
 		return
 	}
 
-	connector := "├── "
+	indent := prefix + treeChars(config).pipe
 	if isLast {
-		connector = "└── "
+		indent = prefix + treeChars(config).space
 	}
+	fmt.Fprintf(w, "%s%s\n", indent, sixel)
+}
 
-	icon, color, typeLabel, uuidDisplay := getItemFormatting(item, config)
+// ansiEscape matches CSI, OSC and two-byte escape sequences.
+var ansiEscape = regexp.MustCompile(`\x1b\[[0-9;?]*[ -/]*[@-~]|\x1b\][^\x07\x1b]*(\x07|\x1b\\)?|\x1b[@-_]`)
 
-	fmt.Printf("%s%s%s%s%s%s%s%s\n", prefix, connector, color, icon, item.Name, colors["reset"], typeLabel, uuidDisplay)
+// displayName returns the name to print for an item, with escape sequences
+// removed and control characters escaped when --escape-names is active.
+func displayName(item *Item, config Config) string {
+	if !config.EscapeNames {
+		return item.Name
+	}
+	return escapeName(item.Name)
+}
 
-	// Print children
-	itemChildren := children[item.UUID]
-	for i, child := range itemChildren {
-		childIsLast := i == len(itemChildren)-1
+func escapeName(name string) string {
+	name = ansiEscape.ReplaceAllString(name, "")
 
-		newPrefix := prefix
-		if isLast {
-			newPrefix += "    "
+	var b strings.Builder
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			fmt.Fprintf(&b, "\\x%02x", r)
 		} else {
-			newPrefix += "│   "
+			b.WriteRune(r)
 		}
-
-		printItem(child, newPrefix, childIsLast, depth+1, children, config)
 	}
+	return b.String()
 }
 
-func printTrashItem(item *Item, prefix string, isLast bool, depth int, config Config) {
-	if depth > 50 {
-		return
-	}
+// knownFields lists the names accepted by --fields.
+var knownFields = []string{"name", "type", "pages", "opened", "created", "size", "date", "uuid"}
 
-	connector := "├── "
-	if isLast {
-		connector = "└── "
+// validateFields checks a --fields list: every name must be known and name must appear exactly once.
+func validateFields(fields []string) error {
+	names := 0
+	for _, field := range fields {
+		if !slices.Contains(knownFields, field) {
+			return fmt.Errorf("unknown field '%s' (valid fields: %s)", field, strings.Join(knownFields, ", "))
+		}
+		if field == "name" {
+			names++
+		}
 	}
-
-	icon, color, typeLabel, uuidDisplay := getItemFormatting(item, config)
-
-	fmt.Printf("%s%s%s%s%s%s%s%s\n", prefix, connector, color, icon, item.Name, colors["reset"], typeLabel, uuidDisplay)
+	if names != 1 {
+		return fmt.Errorf("--fields must contain 'name' exactly once")
+	}
+	return nil
 }
 
-func getItemFormatting(item *Item, config Config) (icon, color, typeLabel, uuidDisplay string) {
+// getItemFormatting returns the icon and color for an item, and the labels to
+// print before and after its name in the order given by --fields.
+func getItemFormatting(item *Item, config Config) (icon, color, before, after string) {
 	if config.UseColor {
 		if item.Type == "CollectionType" {
 			color = colors["folder"]
@@ -344,6 +2210,11 @@ func getItemFormatting(item *Item, config Config) (icon, color, typeLabel, uuidD
 		}
 	}
 
+	highlighted := highlightPattern != nil && highlightPattern.MatchString(item.Name)
+	if highlighted && config.UseColor {
+		color += colors["highlight"]
+	}
+
 	if config.ShowIcons {
 		if item.Type == "CollectionType" {
 			icon = "📁 "
@@ -359,95 +2230,407 @@ func getItemFormatting(item *Item, config Config) (icon, color, typeLabel, uuidD
 		}
 	}
 
+	// Without colors, mark highlighted items instead
+	if highlighted && !config.UseColor {
+		icon = "* " + icon
+	}
+
+	if config.ShowPins && item.Pinned {
+		if config.ASCII {
+			icon = "+ " + icon
+		} else {
+			icon = "★ " + icon
+		}
+	}
+
+	labels := make(map[string][]string)
+
 	if config.ShowLabels && item.Type != "CollectionType" {
 		switch item.DocType {
 		case "pdf":
-			typeLabel = " (pdf)"
+			labels["type"] = append(labels["type"], "(pdf)")
 		case "epub":
-			typeLabel = " (epub)"
+			labels["type"] = append(labels["type"], "(epub)")
 		default:
-			typeLabel = " (notebook)"
+			labels["type"] = append(labels["type"], "(notebook)")
+		}
+	}
+
+	if item.Locked {
+		labels["type"] = append(labels["type"], "(locked)")
+	}
+
+	if item.Empty {
+		labels["type"] = append(labels["type"], "(empty)")
+	}
+
+	if config.Pages && item.Type != "CollectionType" && item.PageCount > 0 {
+		pageText := "pages"
+		if item.PageCount == 1 {
+			pageText = "page"
 		}
+		labels["pages"] = append(labels["pages"], fmt.Sprintf("(%d %s)", item.PageCount, pageText))
+	}
+
+	if config.Opened && !item.LastOpened.IsZero() {
+		labels["opened"] = append(labels["opened"], "(opened "+formatAgo(time.Since(item.LastOpened))+")")
+	}
+
+	if config.Created && !item.Created.IsZero() {
+		labels["created"] = append(labels["created"], "(created "+formatAgo(time.Since(item.Created))+")")
+	}
+
+	if config.Size {
+		labels["size"] = append(labels["size"], "("+formatSize(item.Size)+")")
+	}
+
+	// The date is only shown when --fields asks for it
+	if !item.LastModified.IsZero() {
+		labels["date"] = append(labels["date"], "("+item.LastModified.Local().Format(time.DateOnly)+")")
 	}
 
 	if config.ShowUUID && item.Type != "CollectionType" {
-		uuidDisplay = " [" + item.UUID + "]"
+		labels["uuid"] = append(labels["uuid"], "["+item.UUID+"]")
+	}
+
+	if config.ParentUUID {
+		parent := item.Parent
+		if parent == "" {
+			parent = "root"
+		}
+		labels["uuid"] = append(labels["uuid"], "(parent: "+parent+")")
+	}
+
+	seenName := false
+	for _, field := range config.Fields {
+		if field == "name" {
+			seenName = true
+			continue
+		}
+		for _, label := range labels[field] {
+			if seenName {
+				after += " " + label
+			} else {
+				before += label + " "
+			}
+		}
 	}
 
 	return
 }
 
-// Create symbolic links of the flat structure into a tree structure of filesystem files and directories.
-func linkTree(items map[string]*Item, children map[string][]*Item, config Config) {
-	roots := children["root"]
-	trashItems := children["trash"]
+// linkState collects the results of a linkTree run.
+type linkState struct {
+	failed  []string
+	linked  []linkedFile
+	claimed map[string]bool
+	dirs    []string
 
-	dirCount := 0
-	fileCount := 0
+	// since is the --export-since cutoff; tooOld counts the documents skipped by it
+	since  time.Time
+	tooOld int
 
-	for _, item := range items {
-		if item.Type == "CollectionType" {
-			dirCount++
-		} else {
-			fileCount++
+	// contents finds documents with the same content for --dedupe
+	contents contentIndex
+
+	converterMissing bool
+	rendererMissing  bool
+
+	// With --export-jobs documents are copied or linked in the background,
+	// at most cap(sem) at a time; mu guards failed and linked
+	sem chan struct{}
+	wg  sync.WaitGroup
+	mu  sync.Mutex
+}
+
+// fail records a document that could not be exported.
+func (s *linkState) fail(path, reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failed = append(s.failed, path+": "+reason)
+}
+
+// link records a document placed in the output.
+func (s *linkState) link(path string, item *Item) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.linked = append(s.linked, linkedFile{path: path, uuid: item.UUID, name: item.Name})
+}
+
+// run calls transfer, in the background when --export-jobs allows more than
+// one at a time. Folders and names are still claimed in tree order before
+// it's called, so only the file operations overlap.
+func (s *linkState) run(transfer func()) {
+	if s.sem == nil {
+		transfer()
+		return
+	}
+	s.wg.Add(1)
+	s.sem <- struct{}{}
+	go func() {
+		defer s.wg.Done()
+		defer func() { <-s.sem }()
+		transfer()
+	}()
+}
+
+// linkedFile is a document placed in the output, with its path relative to the output path
+// and the name it has on the tablet.
+type linkedFile struct {
+	path string
+	uuid string
+	name string
+}
+
+// Create symbolic links of the flat structure into a tree structure of filesystem files and directories.
+func linkTree(items map[string]*Item, children map[string][]*Item, config Config) error {
+	roots, trashItems := topLevel(children, config)
+	dirCount, fileCount := treeCounts(items, children, config)
+
+	state := &linkState{claimed: make(map[string]bool)}
+	if config.ExportJobs > 1 && !config.DryRun {
+		state.sem = make(chan struct{}, config.ExportJobs)
+	}
+	if config.ExportSince != "" {
+		age, _ := parseAge(config.ExportSince)
+		state.since = time.Now().Add(-age)
+	}
+	if progress != nil {
+		top := config.Root
+		if top == "" {
+			top = "root"
 		}
+		_, documents := countTree(top, children, 0)
+		progress.start("link", documents)
 	}
 
 	// Link root items
 	for i, item := range roots {
 		isLast := i == len(roots)-1 && len(trashItems) == 0
-		linkItem(item, "", isLast, 0, children, config)
+		linkItem(item, "", isLast, 0, children, config, state)
 	}
+	state.wg.Wait()
 
-	// Print summary
-	dirText := "directories"
-	if dirCount == 1 {
-		dirText = "directory"
+	// Background transfers finish in any order
+	if state.sem != nil {
+		sort.Slice(state.linked, func(i, j int) bool {
+			return state.linked[i].path < state.linked[j].path
+		})
+		sort.Strings(state.failed)
 	}
 
-	fileText := "files"
-	if fileCount == 1 {
-		fileText = "file"
+	if config.NoEmptyDirs && !config.DryRun {
+		removeEmptyDirs(state.dirs, config)
+	}
+
+	if config.Dedupe && config.Verbose {
+		fmt.Fprintf(os.Stderr, "Linked %d documents with identical content, saving %s\n", state.contents.linked, formatSize(state.contents.saved))
+	}
+
+	if config.ExportSince != "" {
+		fmt.Fprintf(os.Stderr, "Exported %d documents, skipped %d not modified in the last %s\n", len(state.linked), state.tooOld, config.ExportSince)
+	}
+
+	if len(state.failed) > 0 {
+		fmt.Fprintf(os.Stderr, "Could not export %d documents:\n", len(state.failed))
+		for _, failure := range state.failed {
+			fmt.Fprintf(os.Stderr, "  %s\n", failure)
+		}
+	}
+
+	printSummary(dirCount, fileCount, onlyTypeCounts(items, children, config), config)
+
+	if config.DryRun {
+		fmt.Fprintf(os.Stderr, "[dry-run] would create %d directories and %d files\n", len(state.dirs), len(state.linked))
+		return nil
+	}
+
+	if config.IDMapFile != "" {
+		if err := writeIDMap(config.IDMapFile, state.linked, config); err != nil {
+			return fmt.Errorf("writing id map: %w", err)
+		}
+	}
+	return nil
+}
+
+// parseAge parses a duration for --export-since. On top of the units of
+// time.ParseDuration it accepts whole days (7d) and weeks (2w).
+func parseAge(s string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if n, ok := strings.CutSuffix(s, suffix); ok {
+			count, err := strconv.Atoi(n)
+			if err != nil || count < 0 {
+				return 0, fmt.Errorf("invalid duration '%s'", s)
+			}
+			return time.Duration(count) * unit, nil
+		}
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid duration '%s' (e.g. 36h, 7d or 2w)", s)
+	}
+	return d, nil
+}
+
+// metadataFieldName matches the names accepted by --name-field.
+var metadataFieldName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// metadataField returns the value of a string or number field of the item's
+// .metadata file, or its UUID for "uuid". It returns "" if the field is
+// missing, empty or of another type.
+func metadataField(item *Item, field, remarkablePath string) string {
+	if field == "uuid" {
+		return item.UUID
+	}
+
+	data, err := fs.ReadFile(sourceFS(remarkablePath), item.UUID+".metadata")
+	if err != nil {
+		return ""
+	}
+	var fields map[string]any
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return ""
+	}
+
+	switch value := fields[field].(type) {
+	case string:
+		return value
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	}
+	return ""
+}
+
+// removeEmptyDirs removes the folders of the export that ended up empty,
+// deepest first so that folders holding only empty folders go too.
+func removeEmptyDirs(dirs []string, config Config) {
+	sort.Slice(dirs, func(i, j int) bool {
+		return len(dirs[i]) > len(dirs[j])
+	})
+
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil || len(entries) > 0 {
+			continue
+		}
+		if err := os.Remove(dir); err != nil {
+			warnf("Error removing empty directory '%s': %v\n", dir, err)
+			continue
+		}
+		if config.Verbose {
+			fmt.Fprintf(os.Stderr, "Removed empty directory '%s'\n", dir)
+		}
+	}
+}
+
+// writeIDMap writes one "path<TAB>uuid<TAB>name" record per exported
+// document, where name is the document's name on the tablet. Records end in a
+// newline, or a NUL byte with --null. Tabs and terminators in the name are
+// replaced with spaces, and UUIDs never contain a tab, so splitting a record
+// at its last two tabs is always safe.
+func writeIDMap(path string, linked []linkedFile, config Config) error {
+	terminator := "\n"
+	if config.Null {
+		terminator = "\x00"
 	}
+	// Keep the name from breaking up its record
+	nameEscaper := strings.NewReplacer("\t", " ", terminator, " ")
 
-	fmt.Printf("%d %s, %d %s\n", dirCount, dirText, fileCount, fileText)
+	var b strings.Builder
+	for _, file := range linked {
+		b.WriteString(file.path + "\t" + file.uuid + "\t" + nameEscaper.Replace(file.name) + terminator)
+	}
+	return os.WriteFile(path, []byte(b.String()), 0644)
 }
 
-func linkItem(item *Item, prefix string, isLast bool, depth int, children map[string][]*Item, config Config) {
+func linkItem(item *Item, prefix string, isLast bool, depth int, children map[string][]*Item, config Config, state *linkState) {
 	if depth > 50 {
 		return
 	}
 
 	itemName := item.Name
+	if config.NameField != "" && item.Type == "DocumentType" {
+		if name := metadataField(item, config.NameField, config.Path); name != "" {
+			itemName = name
+		}
+	}
 	//Remove leading and trailing space from directory name
 	itemName = strings.Trim(itemName, " ")
+	if config.SafeNames {
+		itemName = safeName(itemName)
+	}
 
 	// Create directory or symlink
 	if item.Type == "CollectionType" {
-		// Create directory
-		dirPath := filepath.Join(config.OutputPath, prefix, itemName)
-		err := os.MkdirAll(dirPath, os.ModePerm)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error creating directory '%s': %v\n", dirPath, err)
+		// Create directory, telling apart folders with the same name
+		dirName, ok := claimName(itemName, prefix, item, config, state)
+		if !ok {
 			return
 		}
+		itemName = dirName
+		// With --flat-export folders only become part of the document names
+		if !config.FlatExport {
+			dirPath := filepath.Join(config.OutputPath, prefix, itemName)
+			if config.DryRun {
+				fmt.Printf("[dry-run] mkdir '%s'\n", dirPath)
+			} else if err := os.MkdirAll(dirPath, os.ModePerm); err != nil {
+				warnf("Error creating directory '%s': %v\n", dirPath, err)
+				return
+			}
+			state.dirs = append(state.dirs, dirPath)
+		}
 		// fmt.Fprintf(os.Stdout, "Created directory '%s'\n", dirPath)
 	} else if item.Type == "DocumentType" {
+		queued := false
+		defer func() {
+			if !queued {
+				progress.step()
+			}
+		}()
+
+		if config.FlatExport && prefix != "" {
+			folders := strings.Split(strings.TrimSuffix(prefix, string(os.PathSeparator)), string(os.PathSeparator))
+			itemName = strings.Join(append(folders, itemName), config.FlatSep)
+			prefix = ""
+		}
+
+		if item.LastModified.Before(state.since) {
+			state.tooOld++
+			if config.Verbose {
+				fmt.Fprintf(os.Stderr, "Skipped '%s' (not modified since %s)\n", filepath.Join(prefix, itemName), state.since.Format(time.DateTime))
+			}
+			return
+		}
+
 		// Create symlink
-		srcPath := ""
-		switch item.DocType {
-		case "epub":
-			srcPath = filepath.Join(config.Path, item.UUID+".epub")
-		case "pdf":
-			srcPath = filepath.Join(config.Path, item.UUID+".pdf")
-		default:
+		srcPath := backingFile(item, config.Path)
+		if srcPath == "" {
+			dirName := strings.ReplaceAll(itemName, string(os.PathSeparator), "_")
+			if config.DryRun {
+				if config.RMConverter != "" || config.ExportThumbnails || config.RenderCmd != "" {
+					fmt.Printf("[dry-run] export notebook '%s'\n", filepath.Join(config.OutputPath, prefix, dirName))
+				}
+				return
+			}
+			if config.RMConverter != "" {
+				exportNotebookPages(item, filepath.Join(prefix, dirName), config, state)
+			}
+			if config.ExportThumbnails {
+				exportPageThumbnails(item, filepath.Join(prefix, dirName), config, state)
+			}
+			if config.RenderCmd != "" {
+				if fileName, ok := claimName(dirName+".pdf", prefix, item, config, state); ok {
+					renderNotebook(item, filepath.Join(prefix, fileName), config, state)
+				}
+			}
 			return // Skip for symlinking
 		}
 
 		destDir := filepath.Join(config.OutputPath, prefix)
 		_, err := os.Stat(destDir)
-		if os.IsNotExist(err) {
-			fmt.Fprintf(os.Stderr, "Error: Path '%s' does not exist\n", destDir)
+		if os.IsNotExist(err) && !config.DryRun {
+			warnf("Error: Path '%s' does not exist\n", destDir)
 			return
 		}
 
@@ -455,22 +2638,54 @@ func linkItem(item *Item, prefix string, isLast bool, depth int, children map[st
 		// Sanitize filename
 		fileName = strings.ReplaceAll(fileName, string(os.PathSeparator), "_")
 		// Append file extension if missing
-		if !strings.HasSuffix(fileName, "."+item.DocType) {
-			fileName += "." + item.DocType
+		if !strings.HasSuffix(fileName, "."+item.Ext) {
+			fileName += "." + item.Ext
+		}
+
+		if item.Empty && config.SkipEmpty {
+			if config.Verbose {
+				fmt.Fprintf(os.Stderr, "Skipped '%s' (empty backing file)\n", filepath.Join(prefix, fileName))
+			}
+			return
+		}
+
+		fileName, ok := claimName(fileName, prefix, item, config, state)
+		if !ok {
+			return
 		}
 
 		destPath := filepath.Join(destDir, fileName)
 
-		err = createOrReplaceSymlink(srcPath, destPath)
+		if item.Locked {
+			warnf("Warning: skipping locked document '%s'\n", item.Name)
+			state.fail(filepath.Join(prefix, fileName), "locked")
+			return
+		}
 
+		srcInfo, err := os.Stat(srcPath)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error creating symlink from '%s' to '%s': %v\n", srcPath, destPath, err)
+			warnf("Error reading '%s': %v\n", srcPath, err)
+			state.fail(filepath.Join(prefix, fileName), "unreadable source")
+			return
+		}
+
+		if config.DryRun {
+			fmt.Printf("[dry-run] %s '%s' -> '%s'\n", config.LinkType, destPath, srcPath)
+			state.link(filepath.Join(prefix, fileName), item)
 			return
 		}
-		// fmt.Fprintf(os.Stdout, "Created symlink from '%s' to '%s'\n", srcPath, destPath)
+
+		queued = true
+		state.run(func() {
+			defer progress.step()
+			transferDocument(item, srcPath, srcInfo.Size(), destPath, filepath.Join(prefix, fileName), config, state)
+		})
 	}
 
 	// Link children
+	if config.Depth > 0 && depth+1 >= config.Depth {
+		return
+	}
 	itemChildren := children[item.UUID]
 	for i, child := range itemChildren {
 		childIsLast := i == len(itemChildren)-1
@@ -478,10 +2693,130 @@ func linkItem(item *Item, prefix string, isLast bool, depth int, children map[st
 		newPrefix := prefix
 		newPrefix += itemName + string(os.PathSeparator)
 
-		linkItem(child, newPrefix, childIsLast, depth+1, children, config)
+		linkItem(child, newPrefix, childIsLast, depth+1, children, config, state)
+	}
+}
+
+// transferDocument copies or links the backing file of a document to
+// destPath, relPath below the output path, as set by --copy, --link-type and
+// --dedupe. Errors are reported with the file path, since with --export-jobs
+// transfers of other documents may be reporting at the same time.
+func transferDocument(item *Item, srcPath string, size int64, destPath, relPath string, config Config, state *linkState) {
+	var err error
+	same := ""
+	if config.Dedupe {
+		var pending *exportedFile
+		same, pending = state.contents.reserve(srcPath)
+		if pending != nil {
+			// Duplicates waiting for a failed export are exported on their own
+			defer func() {
+				if err != nil {
+					pending.finish("")
+				} else if config.Copy {
+					pending.finish(destPath)
+				} else {
+					pending.finish(srcPath)
+				}
+			}()
+		}
+	}
+
+	if same != "" {
+		err = createOrReplaceHardlink(same, destPath, config.Force)
+		if err == nil {
+			state.contents.linkedTo(size)
+			if config.Verbose {
+				fmt.Fprintf(os.Stderr, "Linked '%s' to identical '%s'\n", relPath, same)
+			}
+		}
+	} else if config.Copy {
+		err = copyNewFile(srcPath, destPath, config.Force)
+		if err == nil && config.Verbose {
+			fmt.Fprintf(os.Stderr, "Copied '%s'\n", relPath)
+		}
+	} else if config.LinkType == "hardlink" {
+		err = createOrReplaceHardlink(srcPath, destPath, config.Force)
+		if errors.Is(err, syscall.EXDEV) {
+			err = fmt.Errorf("hard links only work within one filesystem; put the output next to the xochitl directory or use --link-type copy")
+		} else if err == nil && config.Verbose {
+			fmt.Fprintf(os.Stderr, "Hard linked '%s'\n", relPath)
+		}
+	} else if err = createOrReplaceSymlink(srcPath, destPath); err != nil && (config.FallbackCopy || runtime.GOOS == "windows") && symlinkUnsupported(err) {
+		err = copyFile(srcPath, destPath)
+		if err == nil && config.Verbose {
+			fmt.Fprintf(os.Stderr, "Copied '%s' (symbolic links not supported)\n", relPath)
+		}
+	} else if symlinkUnsupported(err) {
+		err = fmt.Errorf("symbolic links are not permitted on the output filesystem; use --link-type hardlink or copy, or --fallback-copy")
+	} else if err == nil && config.Verbose {
+		fmt.Fprintf(os.Stderr, "Linked '%s'\n", relPath)
+	}
+
+	if err != nil && config.Copy {
+		warnf("Error copying '%s' to '%s': %v\n", srcPath, destPath, err)
+		state.fail(relPath, err.Error())
+		return
+	} else if err != nil {
+		warnf("Error linking '%s' to '%s': %v\n", destPath, srcPath, err)
+		state.fail(relPath, err.Error())
+		return
+	}
+	// fmt.Fprintf(os.Stdout, "Created symlink from '%s' to '%s'\n", srcPath, destPath)
+	state.link(relPath, item)
+
+	if config.ExportThumbnails {
+		exportCoverThumbnail(item, relPath, config, state)
 	}
 }
 
+// claimName applies --on-collision when another document or folder has
+// already been exported as prefix/fileName in this run. It returns the name to
+// export the item under, or false if it should be skipped. Folders that
+// overwrite one another are merged.
+func claimName(fileName, prefix string, item *Item, config Config, state *linkState) (string, bool) {
+	name := fileName
+	if state.claimed[filepath.Join(prefix, name)] {
+		ext := filepath.Ext(fileName)
+		if item.Type == "CollectionType" {
+			ext = ""
+		}
+		base := strings.TrimSuffix(fileName, ext)
+
+		switch config.OnCollision {
+		case "skip":
+			warnf("Warning: skipping '%s': name already exported\n", filepath.Join(prefix, fileName))
+			return "", false
+		case "overwrite":
+			return name, true
+		case "uuid":
+			name = base + " (" + item.UUID[:min(8, len(item.UUID))] + ")" + ext
+		default:
+			for n := 2; state.claimed[filepath.Join(prefix, name)]; n++ {
+				name = fmt.Sprintf("%s (%d)%s", base, n, ext)
+			}
+		}
+	}
+
+	state.claimed[filepath.Join(prefix, name)] = true
+	return name, true
+}
+
+// safeName replaces every run of characters outside the POSIX portable
+// filename set (letters, digits, dot, dash and underscore) with a single
+// underscore, for --safe-names.
+func safeName(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		portable := r < utf8.RuneSelf && (r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("._-", r))
+		if portable {
+			b.WriteRune(r)
+		} else if !strings.HasSuffix(b.String(), "_") {
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
+
 // createOrReplaceSymlink creates a symlink, replacing an existing symlink at linkPath if present.
 // It will not remove a regular file/dir unless you want that behaviour.
 func createOrReplaceSymlink(target, linkPath string) error {
@@ -498,3 +2833,133 @@ func createOrReplaceSymlink(target, linkPath string) error {
 	}
 	return os.Symlink(target, linkPath)
 }
+
+// createOrReplaceHardlink hard links linkPath to target for --link-type
+// hardlink. A hard link to the same file is left alone; any other file at
+// linkPath is only replaced with --force.
+func createOrReplaceHardlink(target, linkPath string, force bool) error {
+	if fi, err := os.Lstat(linkPath); err == nil {
+		if ti, err := os.Stat(target); err == nil && os.SameFile(fi, ti) {
+			return nil
+		}
+		if !force {
+			return fmt.Errorf("path exists (use --force to overwrite): %s", linkPath)
+		}
+		if err := os.Remove(linkPath); err != nil {
+			return err
+		}
+	}
+	return os.Link(target, linkPath)
+}
+
+// errPrivilegeNotHeld is ERROR_PRIVILEGE_NOT_HELD, returned on Windows when
+// creating symbolic links needs Developer Mode or administrator rights.
+const errPrivilegeNotHeld = syscall.Errno(1314)
+
+// symlinkUnsupported reports whether a symlink error means symbolic links
+// can't be created at all, as on FAT32 or exFAT, or on Windows without the
+// privilege to create them.
+func symlinkUnsupported(err error) bool {
+	if err == nil {
+		return false
+	}
+	if runtime.GOOS == "windows" && errors.Is(err, errPrivilegeNotHeld) {
+		return true
+	}
+	return errors.Is(err, errors.ErrUnsupported) || errors.Is(err, syscall.EPERM)
+}
+
+// copyFile copies src to dst. An existing regular file of the same size is
+// assumed to be an earlier copy and left alone.
+func copyFile(src, dst string) error {
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	if fi, err := os.Lstat(dst); err == nil {
+		if !fi.Mode().IsRegular() {
+			return fmt.Errorf("path exists and is not a regular file: %s", dst)
+		}
+		if fi.Size() == srcInfo.Size() {
+			return nil
+		}
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// copyNewFile copies src to dst for --copy. An existing file at dst is only
+// replaced with --force.
+func copyNewFile(src, dst string, force bool) error {
+	if _, err := os.Lstat(dst); err == nil {
+		if !force {
+			return fmt.Errorf("path exists (use --force to overwrite): %s", dst)
+		}
+		if err := os.Remove(dst); err != nil {
+			return err
+		}
+	}
+	return copyFile(src, dst)
+}
+
+// verifyLinks walks the output path looking for symbolic links whose target
+// no longer exists, removing them when --prune is set. With --prune-max-depth
+// folders deeper than that are left alone.
+func verifyLinks(config Config) error {
+	dangling := 0
+
+	err := filepath.WalkDir(config.OutputPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && config.PruneMaxDepth > 0 && path != config.OutputPath {
+			rel, _ := filepath.Rel(config.OutputPath, path)
+			if strings.Count(rel, string(os.PathSeparator))+1 >= config.PruneMaxDepth {
+				return filepath.SkipDir
+			}
+		}
+		if d.Type()&fs.ModeSymlink == 0 {
+			return nil
+		}
+		if _, err := os.Stat(path); err == nil {
+			return nil
+		}
+
+		target, _ := os.Readlink(path)
+		if config.Prune {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "Removed dangling link '%s' -> '%s'\n", path, target)
+			return nil
+		}
+
+		warnf("Dangling link '%s' -> '%s'\n", path, target)
+		dangling++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if dangling > 0 {
+		return fmt.Errorf("found %d dangling links", dangling)
+	}
+	return nil
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// loadLibrary loads the items of an in-memory xochitl directory. Each entry
+// of metadata maps a UUID to the contents of its .metadata file.
+func loadLibrary(t *testing.T, metadata map[string]string, files fstest.MapFS) map[string]*Item {
+	t.Helper()
+	fsys := fstest.MapFS{}
+	for name, file := range files {
+		fsys[name] = file
+	}
+	for uuid, data := range metadata {
+		fsys[uuid+".metadata"] = &fstest.MapFile{Data: []byte(data)}
+	}
+
+	items, err := loadItems(fsys, nil, nil, 1)
+	if err != nil {
+		t.Fatalf("loading items: %v", err)
+	}
+	return items
+}
+
+// childNames returns the names of a folder's children in their current order.
+func childNames(children map[string][]*Item, parent string) []string {
+	var names []string
+	for _, child := range children[parent] {
+		names = append(names, child.Name)
+	}
+	return names
+}
+
+func TestPinnedFirst(t *testing.T) {
+	items := loadLibrary(t, map[string]string{
+		"f1": `{"visibleName": "Archive", "type": "CollectionType", "parent": ""}`,
+		"f2": `{"visibleName": "Work", "type": "CollectionType", "parent": "", "pinned": true}`,
+		"d1": `{"visibleName": "Alpha", "type": "DocumentType", "parent": ""}`,
+		"d2": `{"visibleName": "Zulu", "type": "DocumentType", "parent": "", "pinned": true}`,
+		"d3": `{"visibleName": "Mike", "type": "DocumentType", "parent": ""}`,
+		"d4": `{"visibleName": "Echo", "type": "DocumentType", "parent": "", "pinned": true}`,
+	}, nil)
+
+	pinnedFirst(items)
+	children := buildChildrenMap(items)
+	sortItems(items, children, Config{Sort: "name"})
+
+	// Folders still come first; pinned items lead each group, by name
+	want := []string{"Work", "Archive", "Echo", "Zulu", "Alpha", "Mike"}
+	if got := childNames(children, "root"); !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestClaimNameCollisions(t *testing.T) {
+	first := &Item{UUID: "aaaaaaaa-0000-0000-0000-000000000000", Name: "Notes", Type: "DocumentType"}
+	second := &Item{UUID: "bbbbbbbb-0000-0000-0000-000000000000", Name: "Notes", Type: "DocumentType"}
+
+	tests := []struct {
+		strategy string
+		want     string
+		ok       bool
+	}{
+		{"number", "Notes (2).pdf", true},
+		{"uuid", "Notes (bbbbbbbb).pdf", true},
+		{"overwrite", "Notes.pdf", true},
+		{"skip", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.strategy, func(t *testing.T) {
+			config := Config{OnCollision: tt.strategy}
+			state := &linkState{claimed: make(map[string]bool)}
+
+			if name, ok := claimName("Notes.pdf", "Work/", first, config, state); name != "Notes.pdf" || !ok {
+				t.Fatalf("first document: got %q, %v", name, ok)
+			}
+			name, ok := claimName("Notes.pdf", "Work/", second, config, state)
+			if name != tt.want || ok != tt.ok {
+				t.Errorf("second document: got %q, %v, want %q, %v", name, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestOnlySummary(t *testing.T) {
+	items := loadLibrary(t, map[string]string{
+		"f1": `{"visibleName": "Books", "type": "CollectionType", "parent": ""}`,
+		"d1": `{"visibleName": "Dune", "type": "DocumentType", "parent": "f1"}`,
+		"d2": `{"visibleName": "Emma", "type": "DocumentType", "parent": "f1"}`,
+		"d3": `{"visibleName": "Paper", "type": "DocumentType", "parent": ""}`,
+		"d4": `{"visibleName": "Notes", "type": "DocumentType", "parent": "f1"}`,
+		"d5": `{"visibleName": "Sketch", "type": "DocumentType", "parent": ""}`,
+	}, fstest.MapFS{
+		"d1.epub": {},
+		"d2.epub": {},
+		"d3.pdf":  {},
+	})
+
+	tests := []struct {
+		name   string
+		config Config
+		want   string
+	}{
+		{"one type", Config{Only: []string{"epub"}}, "2 epub"},
+		{"two types", Config{Only: []string{"pdf", "notebook"}}, "1 pdf, 2 notebook"},
+		{"below root", Config{Only: []string{"epub", "notebook"}, Root: "f1"}, "2 epub, 1 notebook"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filtered, err := applyFilters(items, tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			children := buildChildrenMap(filtered)
+			dirCount, fileCount := treeCounts(filtered, children, tt.config)
+			got := formatSummary(dirCount, fileCount, onlyTypeCounts(filtered, children, tt.config), tt.config)
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJSONIsStable(t *testing.T) {
+	metadata := map[string]string{
+		"f1": `{"visibleName": "Books", "type": "CollectionType", "parent": ""}`,
+		"d1": `{"visibleName": "Notes", "type": "DocumentType", "parent": "f1"}`,
+		"d2": `{"visibleName": "Notes", "type": "DocumentType", "parent": "f1"}`,
+		"d3": `{"visibleName": "Notes", "type": "DocumentType", "parent": "f1"}`,
+		"d4": `{"visibleName": "Old", "type": "DocumentType", "parent": "trash"}`,
+	}
+	config := Config{Name: "tablet", Sort: "name", SortKeys: true}
+
+	render := func() string {
+		items := loadLibrary(t, metadata, nil)
+		children := buildChildrenMap(items)
+		sortItems(items, children, config)
+
+		var b bytes.Buffer
+		if err := printJSON(&b, items, children, config); err != nil {
+			t.Fatal(err)
+		}
+		return b.String()
+	}
+
+	want := render()
+	for range 20 {
+		if got := render(); got != want {
+			t.Fatalf("JSON output changed between runs:\n%s\nthen:\n%s", want, got)
+		}
+	}
+}
+
+func TestSortModifiedTieBreak(t *testing.T) {
+	dir := t.TempDir()
+	same := `"lastModified": "1700000000000"`
+	metadata := map[string]string{
+		"d0": `{"visibleName": "Zulu", "parent": "", "lastModified": "1800000000000"}`,
+		"d1": `{"visibleName": "Beta", "parent": "", ` + same + `}`,
+		"d2": `{"visibleName": "Alpha", "parent": "", ` + same + `}`,
+		"d3": `{"visibleName": "Gamma", "parent": "", ` + same + `}`,
+		"d5": `{"visibleName": "Same", "parent": "", ` + same + `}`,
+		"d4": `{"visibleName": "Same", "parent": "", ` + same + `}`,
+	}
+	for uuid, data := range metadata {
+		if err := os.WriteFile(filepath.Join(dir, uuid+".metadata"), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Beta's file is the newest; Alpha and Gamma's files share a time, and
+	// the two notebooks named Same have no file at all
+	fileTimes := map[string]time.Time{
+		"d1.pdf": time.Unix(1700000300, 0),
+		"d2.pdf": time.Unix(1700000100, 0),
+		"d3.pdf": time.Unix(1700000100, 0),
+	}
+	for name, mtime := range fileTimes {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	items, err := loadItems(os.DirFS(dir), nil, nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	children := buildChildrenMap(items)
+	sortItems(items, children, Config{Path: dir, Sort: "modified"})
+
+	var got []string
+	for _, child := range children["root"] {
+		got = append(got, child.UUID)
+	}
+	want := []string{"d0", "d1", "d2", "d3", "d4", "d5"}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestPruneMaxDepth(t *testing.T) {
+	out := t.TempDir()
+	links := []string{
+		"top.pdf",
+		filepath.Join("Books", "middle.pdf"),
+		filepath.Join("Books", "Sci-Fi", "deep.pdf"),
+	}
+	for _, link := range links {
+		path := filepath.Join(out, link)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(filepath.Join(out, "missing"), path); err != nil {
+			t.Skipf("symbolic links not supported: %v", err)
+		}
+	}
+
+	if err := verifyLinks(Config{OutputPath: out, Prune: true, PruneMaxDepth: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, link := range links {
+		_, err := os.Lstat(filepath.Join(out, link))
+		if pruned := os.IsNotExist(err); pruned != (i < 2) {
+			t.Errorf("%s: pruned = %v, want %v", link, pruned, i < 2)
+		}
+	}
+}
+
+func TestRendererDepth(t *testing.T) {
+	items := loadLibrary(t, map[string]string{
+		"f1": `{"visibleName": "Books", "type": "CollectionType", "parent": ""}`,
+		"f2": `{"visibleName": "Sci-Fi", "type": "CollectionType", "parent": "f1"}`,
+		"d1": `{"visibleName": "Dune", "type": "DocumentType", "parent": "f2"}`,
+	}, nil)
+	children := buildChildrenMap(items)
+
+	render := func(renderer string, config Config) string {
+		var b bytes.Buffer
+		switch renderer {
+		case "text":
+			b.WriteString(renderPlain(items, children, config))
+		case "markdown":
+			printMarkdown(&b, items, children, config)
+		case "html":
+			printHTML(&b, items, children, config)
+		case "json":
+			if err := printJSON(&b, items, children, config); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return b.String()
+	}
+
+	tests := []struct {
+		renderer string
+		config   Config
+		deep     bool
+	}{
+		{"text", Config{}, true},
+		{"text", Config{Depth: 2}, false},
+		{"text", Config{JSONDepth: 2}, true},
+		{"markdown", Config{Depth: 2}, false},
+		{"html", Config{Depth: 2}, false},
+		{"json", Config{}, true},
+		{"json", Config{Depth: 2}, true},
+		{"json", Config{JSONDepth: 2}, false},
+	}
+	for _, tt := range tests {
+		tt.config.PathSep = "/"
+		got := render(tt.renderer, tt.config)
+		if !strings.Contains(got, "Sci-Fi") {
+			t.Errorf("%s with depth %d, json depth %d: missing Sci-Fi:\n%s", tt.renderer, tt.config.Depth, tt.config.JSONDepth, got)
+		}
+		if strings.Contains(got, "Dune") != tt.deep {
+			t.Errorf("%s with depth %d, json depth %d: Dune shown = %v, want %v:\n%s", tt.renderer, tt.config.Depth, tt.config.JSONDepth, !tt.deep, tt.deep, got)
+		}
+	}
+
+	// The summary counts the whole tree whatever the depth
+	if got := render("text", Config{Depth: 1, PathSep: "/"}); !strings.Contains(got, "2 directories, 1 file") {
+		t.Errorf("summary with depth 1 doesn't count the whole tree:\n%s", got)
+	}
+}
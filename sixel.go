@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+)
+
+// thumbnailHeight is the height in pixels of --thumbnails previews.
+const thumbnailHeight = 48
+
+// coverThumbnail returns the name of the thumbnail of a document's first page
+// within the xochitl directory, or an empty string if xochitl hasn't generated
+// one.
+func coverThumbnail(item *Item, remarkablePath string) string {
+	fsys := sourceFS(remarkablePath)
+	dir := item.UUID + ".thumbnails"
+
+	if content, err := readContent(remarkablePath, item.UUID); err == nil {
+		if pages := content.pageIDs(); len(pages) > 0 {
+			for _, ext := range []string{".png", ".jpg"} {
+				name := path.Join(dir, pages[0]+ext)
+				if _, err := fs.Stat(fsys, name); err == nil {
+					return name
+				}
+			}
+		}
+	}
+
+	files, _ := fs.Glob(fsys, dir+"/*.png")
+	if len(files) == 0 {
+		return ""
+	}
+	sort.Strings(files)
+	return files[0]
+}
+
+// thumbnailSixel returns the cover thumbnail of a document as a sixel image,
+// or an empty string if there is none.
+func thumbnailSixel(item *Item, remarkablePath string) string {
+	name := coverThumbnail(item, remarkablePath)
+	if name == "" {
+		return ""
+	}
+
+	f, err := sourceFS(remarkablePath).Open(name)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return ""
+	}
+	return encodeSixel(img, thumbnailHeight)
+}
+
+// encodeSixel scales img to the given height and encodes it as sixel graphics
+// using a fixed 6x6x6 color cube.
+func encodeSixel(img image.Image, height int) string {
+	bounds := img.Bounds()
+	if bounds.Dx() == 0 || bounds.Dy() == 0 {
+		return ""
+	}
+	width := max(bounds.Dx()*height/bounds.Dy(), 1)
+
+	// Nearest-neighbour scale and quantize every pixel to a palette index
+	pixels := make([]int, width*height)
+	used := make(map[int]bool)
+	for y := range height {
+		for x := range width {
+			r, g, b, _ := img.At(bounds.Min.X+x*bounds.Dx()/width, bounds.Min.Y+y*bounds.Dy()/height).RGBA()
+			index := int((r*5+0x7fff)/0xffff)*36 + int((g*5+0x7fff)/0xffff)*6 + int((b*5+0x7fff)/0xffff)
+			pixels[y*width+x] = index
+			used[index] = true
+		}
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "\x1bPq\"1;1;%d;%d", width, height)
+
+	palette := make([]int, 0, len(used))
+	for index := range used {
+		palette = append(palette, index)
+	}
+	sort.Ints(palette)
+	for _, index := range palette {
+		fmt.Fprintf(&sb, "#%d;2;%d;%d;%d", index, index/36*20, index/6%6*20, index%6*20)
+	}
+
+	for band := 0; band < height; band += 6 {
+		bandColors := make(map[int]bool)
+		for y := band; y < min(band+6, height); y++ {
+			for x := range width {
+				bandColors[pixels[y*width+x]] = true
+			}
+		}
+
+		for _, index := range palette {
+			if !bandColors[index] {
+				continue
+			}
+			fmt.Fprintf(&sb, "#%d", index)
+
+			// Run-length encode the six-pixel columns of this color
+			var last byte
+			run := 0
+			flush := func() {
+				if run > 3 {
+					fmt.Fprintf(&sb, "!%d%c", run, last)
+				} else {
+					sb.WriteString(strings.Repeat(string(last), run))
+				}
+			}
+			for x := range width {
+				bits := 0
+				for k := range 6 {
+					if y := band + k; y < height && pixels[y*width+x] == index {
+						bits |= 1 << k
+					}
+				}
+				char := byte(63 + bits)
+				if run > 0 && char != last {
+					flush()
+					run = 0
+				}
+				last = char
+				run++
+			}
+			flush()
+			sb.WriteByte('$')
+		}
+		sb.WriteByte('-')
+	}
+
+	sb.WriteString("\x1b\\")
+	return sb.String()
+}
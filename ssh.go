@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// openSource returns the xochitl directory to read: config.Path on the local
+// filesystem, or on the device given with --ssh. The returned function closes
+// the connection.
+func openSource(config Config) (fs.FS, func(), error) {
+	if config.SSH == "" {
+		return os.DirFS(config.Path), func() {}, nil
+	}
+
+	client, err := dialSSH(config.SSH, config.Identity)
+	if err != nil {
+		return nil, nil, fmt.Errorf("connecting to %s: %w", config.SSH, err)
+	}
+
+	sftpClient, err := sftp.NewClient(client)
+	if err != nil {
+		client.Close()
+		return nil, nil, fmt.Errorf("starting SFTP on %s: %w", config.SSH, err)
+	}
+
+	closeFn := func() {
+		sftpClient.Close()
+		client.Close()
+	}
+	return sftpFS{client: sftpClient, root: config.Path}, closeFn, nil
+}
+
+// dialSSH connects to [user@]host[:port], logging in as root by default. It
+// authenticates with the --identity key if given and the SSH agent, and checks
+// the host key against ~/.ssh/known_hosts.
+func dialSSH(target, identity string) (*ssh.Client, error) {
+	user, host, ok := strings.Cut(target, "@")
+	if !ok {
+		user, host = "root", target
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "22")
+	}
+
+	var auth []ssh.AuthMethod
+	if identity != "" {
+		key, err := os.ReadFile(identity)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("reading identity '%s': %w", identity, err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+		if conn, err := net.Dial("unix", socket); err == nil {
+			auth = append(auth, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+	if len(auth) == 0 {
+		return nil, fmt.Errorf("no SSH agent running and no --identity given")
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	hostKeys, err := knownhosts.New(filepath.Join(home, ".ssh", "known_hosts"))
+	if err != nil {
+		return nil, fmt.Errorf("reading known hosts (connect once with ssh to add the device): %w", err)
+	}
+
+	return ssh.Dial("tcp", host, &ssh.ClientConfig{
+		User:            user,
+		Auth:            auth,
+		HostKeyCallback: hostKeys,
+	})
+}
+
+// sftpFS is an fs.FS over a directory on an SFTP server.
+type sftpFS struct {
+	client *sftp.Client
+	root   string
+}
+
+func (f sftpFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	return f.client.Open(path.Join(f.root, name))
+}
+
+func (f sftpFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	infos, err := f.client.ReadDir(path.Join(f.root, name))
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]fs.DirEntry, len(infos))
+	for i, info := range infos {
+		entries[i] = fs.FileInfoToDirEntry(info)
+	}
+	return entries, nil
+}
+
+func (f sftpFS) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	return f.client.Stat(path.Join(f.root, name))
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"runtime"
+	"sort"
+	"sync"
+)
+
+const stateVersion = 1
+
+// State records what each document looked like on the previous run.
+type State struct {
+	Version   int                       `json:"version"`
+	Documents map[string]*DocumentState `json:"documents"`
+}
+
+type DocumentState struct {
+	Path    string `json:"path"`
+	Hash    string `json:"hash"`
+	Removed bool   `json:"removed,omitempty"`
+}
+
+// runStateReport compares the documents against the state file, prints the
+// differences and records the current state for the next run.
+func runStateReport(w io.Writer, items map[string]*Item, config Config) error {
+	previous, err := loadState(config.StateFile)
+	if err != nil {
+		return err
+	}
+
+	hashes := hashDocuments(items, config.Path)
+
+	current := &State{Version: stateVersion, Documents: make(map[string]*DocumentState)}
+	for uuid, item := range items {
+		if item.Type == "CollectionType" {
+			continue
+		}
+		current.Documents[uuid] = &DocumentState{
+			Path: formatPath(ancestorNames(item, items), config),
+			Hash: hashes[uuid],
+		}
+	}
+
+	if previous == nil {
+		fmt.Fprintf(w, "No previous state, recorded %d documents\n", len(current.Documents))
+		return writeJSONFile(config.StateFile, current)
+	}
+
+	var lines []string
+	for uuid, doc := range current.Documents {
+		old, ok := previous.Documents[uuid]
+		switch {
+		case !ok || old.Removed:
+			lines = append(lines, "added    "+doc.Path)
+		case old.Hash != doc.Hash:
+			lines = append(lines, "changed  "+doc.Path)
+		case old.Path != doc.Path && !config.ContentChangesOnly:
+			lines = append(lines, "moved    "+old.Path+" -> "+doc.Path)
+		}
+	}
+	for uuid, old := range previous.Documents {
+		if _, ok := current.Documents[uuid]; ok {
+			continue
+		}
+		if !old.Removed {
+			lines = append(lines, "removed  "+old.Path)
+		}
+		// Keep removed documents around so their history survives until --prune-state
+		if !config.PruneState {
+			current.Documents[uuid] = &DocumentState{Path: old.Path, Hash: old.Hash, Removed: true}
+		}
+	}
+
+	sort.Strings(lines)
+	for _, line := range lines {
+		fmt.Fprintln(w, line)
+	}
+
+	return writeJSONFile(config.StateFile, current)
+}
+
+// loadState reads a state file, returning nil if it doesn't exist yet.
+func loadState(path string) (*State, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var state State
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("reading state file '%s': %w", path, err)
+	}
+	if state.Version != stateVersion {
+		return nil, fmt.Errorf("state file '%s' has unsupported version %d", path, state.Version)
+	}
+	return &state, nil
+}
+
+// hashDocuments hashes the content of every document using a bounded number of workers.
+func hashDocuments(items map[string]*Item, remarkablePath string) map[string]string {
+	hashes := make(map[string]string)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	queue := make(chan *Item)
+	for range runtime.NumCPU() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range queue {
+				hash := hashDocument(item, remarkablePath)
+				mu.Lock()
+				hashes[item.UUID] = hash
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, item := range items {
+		if item.Type != "CollectionType" {
+			queue <- item
+		}
+	}
+	close(queue)
+
+	wg.Wait()
+	return hashes
+}
+
+// hashDocument hashes the backing file and page files of a document, so
+// edits to notebooks and annotations change the hash as well.
+func hashDocument(item *Item, remarkablePath string) string {
+	fsys := sourceFS(remarkablePath)
+	var files []string
+	if item.Ext != "" {
+		files = append(files, item.UUID+"."+item.Ext)
+	}
+
+	pages, _ := fs.Glob(fsys, item.UUID+"/*")
+	sort.Strings(pages)
+	files = append(files, pages...)
+
+	h := sha256.New()
+	for _, file := range files {
+		f, err := fsys.Open(file)
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(h, "%s\x00", path.Base(file))
+		io.Copy(h, f)
+		f.Close()
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// tableColumn is one column of the tabular outputs.
+type tableColumn struct {
+	name  string
+	value func(item *Item, items map[string]*Item, config Config) string
+}
+
+// tableColumns are the columns of --tsv, in order.
+var tableColumns = []tableColumn{
+	{"path", func(item *Item, items map[string]*Item, config Config) string {
+		return formatPath(ancestorNames(item, items), config)
+	}},
+	{"name", func(item *Item, items map[string]*Item, config Config) string { return item.Name }},
+	{"type", func(item *Item, items map[string]*Item, config Config) string {
+		if item.Type == "CollectionType" {
+			return "folder"
+		}
+		return item.DocType
+	}},
+	{"uuid", func(item *Item, items map[string]*Item, config Config) string { return item.UUID }},
+	{"parent", func(item *Item, items map[string]*Item, config Config) string { return item.Parent }},
+	{"modified", func(item *Item, items map[string]*Item, config Config) string {
+		if item.LastModified.IsZero() {
+			return ""
+		}
+		return item.LastModified.UTC().Format(time.RFC3339)
+	}},
+}
+
+// tableRows returns the items in tree order: each folder before its contents,
+// then the trash. With --flat-sort path they are sorted by full path instead.
+func tableRows(items map[string]*Item, children map[string][]*Item, config Config) []*Item {
+	var rows []*Item
+	var walk func(items []*Item, depth int)
+	walk = func(items []*Item, depth int) {
+		if depth > 50 {
+			return
+		}
+		for _, item := range items {
+			rows = append(rows, item)
+			walk(children[item.UUID], depth+1)
+		}
+	}
+
+	roots, trashItems := topLevel(children, config)
+	walk(roots, 0)
+	walk(trashItems, 0)
+
+	if config.FlatSort == "path" {
+		paths := make(map[*Item]string, len(rows))
+		for _, item := range rows {
+			paths[item] = formatPath(ancestorNames(item, items), config)
+		}
+		sort.SliceStable(rows, func(i, j int) bool {
+			return paths[rows[i]] < paths[rows[j]]
+		})
+	}
+	return rows
+}
+
+// tsvEscaper escapes the characters that would break a TSV field.
+var tsvEscaper = strings.NewReplacer(`\`, `\\`, "\t", `\t`, "\n", `\n`, "\r", `\r`)
+
+// printTSV prints one tab-separated line per item with tableColumns, after a
+// header line unless --no-header is given. Nothing is quoted; backslashes,
+// tabs and newlines in values are escaped as \\, \t and \n.
+func printTSV(w io.Writer, items map[string]*Item, children map[string][]*Item, config Config) {
+	fields := make([]string, len(tableColumns))
+
+	if !config.NoHeader {
+		for i, column := range tableColumns {
+			fields[i] = column.name
+		}
+		fmt.Fprintln(w, strings.Join(fields, "\t"))
+	}
+
+	for _, item := range tableRows(items, children, config) {
+		for i, column := range tableColumns {
+			fields[i] = tsvEscaper.Replace(column.value(item, items, config))
+		}
+		fmt.Fprintln(w, strings.Join(fields, "\t"))
+	}
+}
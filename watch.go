@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// fingerprint is a cheap summary of the metadata files used to notice changes
+// without reloading everything. It works on network filesystems where change
+// notifications aren't delivered.
+type fingerprint struct {
+	count    int
+	maxMtime time.Time
+}
+
+func metadataFingerprint(fsys fs.FS) (fingerprint, error) {
+	files, err := fs.Glob(fsys, "*.metadata")
+	if err != nil {
+		return fingerprint{}, err
+	}
+
+	fp := fingerprint{count: len(files)}
+	for _, file := range files {
+		fi, err := fs.Stat(fsys, file)
+		if err != nil {
+			continue
+		}
+		if fi.ModTime().After(fp.maxMtime) {
+			fp.maxMtime = fi.ModTime()
+		}
+	}
+	return fp, nil
+}
+
+// pollTree re-runs rmtree every time the metadata fingerprint changes, checking
+// at the --poll-interval. The fingerprint is read through its own connection
+// with --ssh. It only returns if the xochitl directory can't be opened.
+func pollTree(config Config) error {
+	fsys, closeSource, err := openSource(config)
+	if err != nil {
+		return err
+	}
+	defer closeSource()
+
+	var last fingerprint
+	for {
+		fp, err := metadataFingerprint(fsys)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		} else if fp != last {
+			last = fp
+			if isTerminal(os.Stdout) {
+				fmt.Print("\033[H\033[2J")
+			}
+			if err := run(config); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			}
+		}
+		time.Sleep(config.PollInterval)
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// zipTree writes the documents into a zip archive laid out like the folder
+// tree, as --symlinks would on disk, down to --depth levels.
+func zipTree(zipPath string, items map[string]*Item, children map[string][]*Item, config Config) error {
+	f, err := os.Create(zipPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	zw := zip.NewWriter(f)
+	state := &linkState{claimed: make(map[string]bool)}
+
+	roots, _ := topLevel(children, config)
+	dirCount, fileCount := treeCounts(items, children, config)
+	for _, item := range roots {
+		if err := zipItem(zw, item, "", 0, children, config, state); err != nil {
+			return err
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	if len(state.failed) > 0 {
+		fmt.Fprintf(os.Stderr, "Could not export %d documents:\n", len(state.failed))
+		for _, failure := range state.failed {
+			fmt.Fprintf(os.Stderr, "  %s\n", failure)
+		}
+	}
+
+	printSummary(dirCount, fileCount, onlyTypeCounts(items, children, config), config)
+
+	if config.IDMapFile != "" {
+		if err := writeIDMap(config.IDMapFile, state.linked, config); err != nil {
+			return fmt.Errorf("writing id map: %w", err)
+		}
+	}
+	return f.Close()
+}
+
+// zipItem adds an item to the archive below prefix, which is empty or ends in
+// a slash. Only errors writing the archive itself are returned; documents that
+// can't be read are reported and skipped.
+func zipItem(zw *zip.Writer, item *Item, prefix string, depth int, children map[string][]*Item, config Config, state *linkState) error {
+	if depth > 50 {
+		return nil
+	}
+
+	itemName := strings.ReplaceAll(strings.Trim(item.Name, " "), "/", "_")
+	if config.SafeNames {
+		itemName = safeName(itemName)
+	}
+
+	if item.Type == "CollectionType" {
+		dirName, ok := claimName(itemName, prefix, item, config, state)
+		if !ok {
+			return nil
+		}
+		dir := prefix + dirName + "/"
+		if _, err := zw.CreateHeader(&zip.FileHeader{Name: dir, Modified: item.LastModified}); err != nil {
+			return err
+		}
+		if config.Depth > 0 && depth+1 >= config.Depth {
+			return nil
+		}
+		for _, child := range children[item.UUID] {
+			if err := zipItem(zw, child, dir, depth+1, children, config, state); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	srcPath := backingFile(item, config.Path)
+	if srcPath == "" {
+		if config.RMConverter == "" && config.RenderCmd == "" {
+			warnf("Warning: skipping notebook '%s' (no --rm-converter or --render-cmd)\n", prefix+itemName)
+			return nil
+		}
+		if config.RMConverter != "" {
+			if err := zipNotebookPages(zw, item, prefix+itemName, config, state); err != nil {
+				return err
+			}
+		}
+		if config.RenderCmd != "" {
+			return zipRenderedNotebook(zw, item, prefix, itemName, config, state)
+		}
+		return nil
+	}
+
+	fileName := itemName
+	if !strings.HasSuffix(fileName, "."+item.Ext) {
+		fileName += "." + item.Ext
+	}
+
+	if item.Locked {
+		warnf("Warning: skipping locked document '%s'\n", item.Name)
+		state.fail(prefix+fileName, "locked")
+		return nil
+	}
+
+	if item.Empty && config.SkipEmpty {
+		if config.Verbose {
+			fmt.Fprintf(os.Stderr, "Skipped '%s' (empty backing file)\n", prefix+fileName)
+		}
+		return nil
+	}
+
+	fileName, ok := claimName(fileName, prefix, item, config, state)
+	if !ok {
+		return nil
+	}
+
+	src, err := os.Open(srcPath)
+	if err != nil {
+		warnf("Error reading '%s': %v\n", srcPath, err)
+		state.fail(prefix+fileName, "unreadable source")
+		return nil
+	}
+	defer src.Close()
+
+	if err := zipFile(zw, prefix+fileName, item, src); err != nil {
+		return err
+	}
+	if config.Verbose {
+		fmt.Fprintf(os.Stderr, "Added '%s'\n", prefix+fileName)
+	}
+	state.link(prefix+fileName, item)
+	return nil
+}
+
+// zipNotebookPages converts a notebook's pages with --rm-converter into a
+// temporary directory and adds them to the archive in the folder dir.
+func zipNotebookPages(zw *zip.Writer, item *Item, dir string, config Config, state *linkState) error {
+	tmp, err := os.MkdirTemp("", "rmtree-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	pageConfig := config
+	pageConfig.OutputPath = tmp
+	exportNotebookPages(item, item.UUID, pageConfig, state)
+
+	pages, _ := os.ReadDir(filepath.Join(tmp, item.UUID))
+	for _, page := range pages {
+		f, err := os.Open(filepath.Join(tmp, item.UUID, page.Name()))
+		if err != nil {
+			return err
+		}
+		err = zipFile(zw, path.Join(dir, page.Name()), item, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// zipRenderedNotebook renders a notebook with --render-cmd into a temporary
+// file and adds it to the archive as prefix/name.pdf.
+func zipRenderedNotebook(zw *zip.Writer, item *Item, prefix, name string, config Config, state *linkState) error {
+	fileName, ok := claimName(name+".pdf", prefix, item, config, state)
+	if !ok {
+		return nil
+	}
+
+	tmp, err := os.MkdirTemp("", "rmtree-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	dst := filepath.Join(tmp, item.UUID+".pdf")
+	err = runRenderCmd(item, dst, config, state)
+	if errors.Is(err, errRendererMissing) {
+		return nil
+	}
+	if err != nil {
+		warnf("Error rendering '%s': %v\n", item.Name, err)
+		state.fail(prefix+fileName, err.Error())
+		return nil
+	}
+
+	f, err := os.Open(dst)
+	if err != nil {
+		warnf("Error rendering '%s': %v\n", item.Name, err)
+		state.fail(prefix+fileName, "render command wrote no PDF")
+		return nil
+	}
+	defer f.Close()
+
+	if err := zipFile(zw, prefix+fileName, item, f); err != nil {
+		return err
+	}
+	state.link(prefix+fileName, item)
+	return nil
+}
+
+// zipFile adds the contents of src to the archive as name, dated like item.
+func zipFile(zw *zip.Writer, name string, item *Item, src io.Reader) error {
+	w, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: item.LastModified,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, src)
+	return err
+}